@@ -0,0 +1,45 @@
+// reference(s):
+// 	https://www.postgresql.org/docs/current/explicit-locking.html#ADVISORY-LOCKS
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+)
+
+// keys are namespaced so that they don't collide with the advisory locks of other apps using the metrics DB
+const advisoryLockNamespace string = "heroku-pg-logdrain-to-pgwatch2-metrics"
+
+// returns the advisory lock key of name (e.g. a metric name), the same on every dyno
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(advisoryLockNamespace + ":" + name))
+	return int64(h.Sum64())
+}
+
+// runs fn in a transaction holding the advisory lock of name, so that schema changes (e.g. partitions creation) are
+// serialized across all the dynos writing to the same metrics DB.
+// The transaction level lock (pg_advisory_xact_lock) is used instead of pg_advisory_lock, as it is released when the
+// transaction ends and can't be left behind on a pooled connection.
+func withAdvisoryLock(ctx context.Context, s *store, name string, fn func(tx *sql.Tx) error) error {
+	return s.withRetry(ctx, "advisory lock "+name, func(db *sql.DB) error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.ExecContext(ctx, "select pg_advisory_xact_lock($1);", advisoryLockKey(name)); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err = fn(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const BatchSizeEnv string = "HKPG_LOGDRAIN_BATCH_SIZE"
+const BatchFlushIntervalEnv string = "HKPG_LOGDRAIN_BATCH_FLUSH_INTERVAL"
+
+// the max number of rows waiting to be written by a sink, over it the rows are spooled (or dropped without a spool) for
+// that sink only, so that a slow sink doesn't slow down the others
+const BatchMaxPendingEnv string = "HKPG_LOGDRAIN_BATCH_MAX_PENDING"
+
+const defaultBatchSize int = 500
+const defaultBatchFlushInterval time.Duration = 5 * time.Second
+const defaultBatchMaxPending int = 5000
+
+// a single measurement waiting to be written by the sinks
+type metricRow struct {
+	metric string
+	time   time.Time
+	dbname string
+	data   []byte
+	tags   []byte // tag_data, NULL if nil
+}
+
+// batchWriter collects the rows produced by the log lines of one or more requests and writes them to its sink
+// with a single batch per metric, instead of a round-trip for each sample.
+// Rows are flushed when maxRows rows are pending or every flushInterval, whichever comes first.
+// If a spool is set, the rows that can't be written because of a transient (or deferred) error are spooled and replayed every replayInterval.
+// A batchWriter is a Sink itself, buffering the rows of WriteBatch up to maxPending rows.
+type batchWriter struct {
+	sink          Sink
+	maxRows       int
+	maxPending    int
+	flushInterval time.Duration
+
+	spool          *spool
+	replayInterval time.Duration
+
+	mu      sync.Mutex
+	rows    map[string][]metricRow // metric name -> pending rows
+	pending int
+
+	// the writes of the loop, canceled once the deadline of Close is hit
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	flushCh chan struct{}
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+
+	dropped    atomic.Int64 // rows not written because of a fatal error, or of a full buffer without a spool
+	overflowed atomic.Int64 // rows not buffered because maxPending rows were pending
+}
+
+func newBatchWriter(sink Sink, maxRows int, maxPending int, flushInterval time.Duration) *batchWriter {
+	if maxRows <= 0 {
+		maxRows = defaultBatchSize
+	}
+	if maxPending <= 0 {
+		maxPending = defaultBatchMaxPending
+	}
+	// a flush is requested once maxRows rows are pending, the writers would wait forever below it
+	if maxPending < maxRows {
+		maxPending = maxRows
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultBatchFlushInterval
+	}
+
+	bw := &batchWriter{
+		sink:          sink,
+		maxRows:       maxRows,
+		maxPending:    maxPending,
+		flushInterval: flushInterval,
+		rows:          make(map[string][]metricRow),
+		flushCh:       make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+	}
+	bw.ctx, bw.cancel = context.WithCancel(context.Background())
+	return bw
+}
+
+// starts the background goroutine that flushes the pending rows
+func (bw *batchWriter) start() {
+	bw.wg.Add(1)
+	go bw.loop()
+}
+
+func (bw *batchWriter) loop() {
+	defer bw.wg.Done()
+
+	ticker := time.NewTicker(bw.flushInterval)
+	defer ticker.Stop()
+
+	// a nil channel never fires, so there is no replay without a spool
+	var replayC <-chan time.Time
+	if bw.spool != nil {
+		if bw.replayInterval <= 0 {
+			bw.replayInterval = defaultSpoolReplayInterval
+		}
+		replayTicker := time.NewTicker(bw.replayInterval)
+		defer replayTicker.Stop()
+		replayC = replayTicker.C
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			bw.flush(bw.ctx)
+		case <-bw.flushCh:
+			bw.flush(bw.ctx)
+		case <-replayC:
+			bw.replaySpool()
+		case <-bw.stopCh:
+			bw.flush(bw.ctx)
+			if bw.spool != nil {
+				bw.spool.close()
+			}
+			return
+		}
+	}
+}
+
+// never waits for the sink, as the fanout writes to the sinks one after the other: while maxPending rows are pending
+// (e.g. the sink is slow) the rows are spooled, or dropped without a spool
+func (bw *batchWriter) WriteBatch(_ context.Context, rows []metricRow) error {
+	bw.mu.Lock()
+	if bw.pending >= bw.maxPending {
+		bw.mu.Unlock()
+		bw.overflow(rows)
+		return nil
+	}
+	for _, row := range rows {
+		bw.rows[row.metric] = append(bw.rows[row.metric], row)
+	}
+	bw.pending += len(rows)
+	full := bw.pending >= bw.maxRows
+	bw.mu.Unlock()
+
+	if full {
+		// non blocking, a flush is already requested if the channel is full
+		select {
+		case bw.flushCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (bw *batchWriter) overflow(rows []metricRow) {
+	bw.overflowed.Add(int64(len(rows)))
+	if bw.spool != nil {
+		err := bw.spool.append(rows)
+		if err == nil {
+			return
+		}
+		fmt.Printf("spool: unable to spool %v rows: %v\n", len(rows), err)
+	}
+
+	bw.dropped.Add(int64(len(rows)))
+	if isEnv(DebugEnv) {
+		fmt.Printf("[batch_writer.go:overflow] dropped %v rows, %v rows are pending\n", len(rows), bw.maxPending)
+	}
+}
+
+// writes all the pending rows, one batch for each metric. Once ctx is done, the rows not written yet are spooled.
+func (bw *batchWriter) flush(ctx context.Context) {
+	bw.mu.Lock()
+	if bw.pending == 0 {
+		bw.mu.Unlock()
+		return
+	}
+	rows := bw.rows
+	bw.rows = make(map[string][]metricRow)
+	bw.pending = 0
+	bw.mu.Unlock()
+
+	for metric, metricRows := range rows {
+		err := ctx.Err()
+		if err == nil {
+			err = bw.sink.WriteBatch(ctx, metricRows)
+		}
+		if err != nil {
+			// the rows would fail again once replayed (e.g. a constraint violation), and so would block the spool
+			if classifyError(err) == errorFatal {
+				bw.dropped.Add(int64(len(metricRows)))
+				fmt.Printf("sink error: dropped %v rows of %v: %v\n", len(metricRows), metric, err)
+				continue
+			}
+			fmt.Printf("sink error: unable to write %v rows of %v: %v\n", len(metricRows), metric, err)
+
+			if bw.spool != nil {
+				if err := bw.spool.append(metricRows); err != nil {
+					fmt.Printf("spool: unable to spool %v rows of %v: %v\n", len(metricRows), metric, err)
+				}
+			}
+			continue
+		}
+
+		if isEnv(DebugEnv) {
+			fmt.Printf("[batch_writer.go:flush] written %v rows of %v\n", len(metricRows), metric)
+		}
+	}
+
+	if ctx.Err() == nil {
+		if err := bw.sink.Flush(ctx); err != nil {
+			fmt.Printf("sink error: unable to flush: %v\n", err)
+		}
+	}
+}
+
+// writes the spooled rows once the sink is reachable again
+func (bw *batchWriter) replaySpool() {
+	if rc, ok := bw.sink.(readinessChecker); ok {
+		if err := rc.ping(bw.ctx); err != nil {
+			if isEnv(DebugEnv) {
+				fmt.Printf("[batch_writer.go:replaySpool] sink still unreachable: %v\n", err)
+			}
+			return
+		}
+	}
+
+	err := bw.spool.replay(func(rows []metricRow) error {
+		if err := bw.sink.WriteBatch(bw.ctx, rows); err != nil {
+			return err
+		}
+		return bw.sink.Flush(bw.ctx)
+	})
+	if err != nil {
+		fmt.Printf("spool: replay interrupted: %v\n", err)
+	}
+}
+
+// writes the pending rows now, flush flushes the sink as well and spools the rows it fails to write
+func (bw *batchWriter) Flush(ctx context.Context) error {
+	bw.flush(ctx)
+	return nil
+}
+
+// stops the background goroutine, writes the rows still pending and closes the sink.
+// Once ctx is done the write in progress is interrupted, and its rows and the pending ones are spooled.
+func (bw *batchWriter) Close(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			bw.cancel()
+		case <-stopped:
+		}
+	}()
+
+	close(bw.stopCh)
+	bw.wg.Wait()
+	close(stopped)
+
+	err := bw.sink.Close(ctx)
+	bw.cancel()
+	return err
+}
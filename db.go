@@ -5,10 +5,10 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
-	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -16,95 +16,178 @@ import (
 
 const MetricsDbUrlEnv string = "PGWATCH2_URL"
 
-var db *sql.DB
-var cpuLoadInsertStmt *sql.Stmt
-var herokuPgStatsInsertStmt *sql.Stmt
-var initMetricsTableAndPartitionsSelectStmt *sql.Stmt
+// the pgwatch2 metrics DB and its jobs, all nil if the pgwatch2 sink is not enabled
+var metricsStore *store
+var partitions *partitionManager
+var retention *retentionJob
+var sourcesDB *sourcesTable
+var dbnames *dbnameRegistry
+
+// the configured sinks, each one behind its batch writer
+var metricsSink *fanoutSink
+var metricsWriters []*batchWriter
+var metricsSinkErr error
+
+// rows are not written immediately, they are batched and written by the batch writer of each sink
+func metricInsert(metric string, time time.Time, dbname string, data []byte, tags []byte) error {
+	if metricsSink == nil {
+		return metricsSinkErr
+	}
+	return metricsSink.WriteBatch(context.Background(), []metricRow{{metric: metric, time: time, dbname: dbname, data: data, tags: tags}})
+}
+
+// no connection is established here, see startMetricsDB
+func init() {
+	registerStats("rates", counters.stats)
 
-func herokuPgStatsInsert(time time.Time, dbname string, data []byte) error {
-	_, err := herokuPgStatsInsertStmt.Exec(
-		time,
-		dbname,
-		data)
-	if err != nil {
-		fmt.Printf("DB error: %v\n", err)
+	if sinkEnabled(Pgwatch2SinkName) {
+		initPgwatch2MetricsDB()
 	}
 
-	return err
-}
+	if metricsSink, metricsWriters, metricsSinkErr = newSinksFromEnv(); metricsSinkErr == nil {
+		registerStats("sinks", metricsSink.stats)
+	}
 
-func cpuLoadInsert(time time.Time, dbname string, data []byte) error {
-	_, err := cpuLoadInsertStmt.Exec(
-		time,
-		dbname,
-		data)
-	if err != nil {
-		fmt.Printf("DB error: %v\n", err)
+	// they would be silently ignored, the startup fails instead (see startMetricsDB)
+	if names := pgwatch2StoreEnvs(); metricsSinkErr == nil && metricsStore == nil && len(names) > 0 {
+		metricsSinkErr = fmt.Errorf("%v require the %v sink, add it to %v or unset them", names, Pgwatch2SinkName, SinksEnv)
 	}
+}
 
-	return err
+// returns the env vars set for the features stored in the pgwatch2 metrics DB, which only exists with the pgwatch2 sink
+func pgwatch2StoreEnvs() []string {
+	var names []string
+	for _, name := range []string{SourcesTableEnv, RegisterDbnamesEnv, RatesSeedEnv, RetentionEnv} {
+		if isEnv(name) {
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
-func initMetricsTableAndPartitions(metricname string, time time.Time) error {
-	_, err := initMetricsTableAndPartitionsSelectStmt.Exec(
-		metricname,
-		time)
-	if err != nil {
-		fmt.Printf("DB error: %v\n", err)
+func initPgwatch2MetricsDB() {
+	metricsStore = newStore(MetricsDbUrlEnv, envInt(DbMaxRetriesEnv, defaultDbMaxRetries))
+
+	partitions = newPartitionManager(metricsStore, logMappings.metrics()...)
+	registerStats("partitions", partitions.stats)
+
+	// retention is optional, without it partitions are never dropped
+	if retention = newRetentionJobFromEnv(metricsStore, partitions); retention != nil {
+		registerStats("retention", retention.stats)
 	}
 
-	return err
+	// rates restart from the last stored sample, instead of waiting for a second sample, after a restart
+	if isEnv(RatesSeedEnv) {
+		counters.seed = storedCounters(metricsStore)
+	}
+
+	// the drain_sources table is optional, without it the sources are only configured by SOURCES (or the sources file)
+	if isEnv(SourcesTableEnv) {
+		sourcesDB = newSourcesTable(metricsStore, sources)
+		registerStats("sources_table", sourcesDB.stats)
+	}
+
+	// the dbnames registration is optional, without it the dashboards only list the dbnames pgwatch2 knows about
+	if isEnv(RegisterDbnamesEnv) {
+		var configStore *store
+		if isEnv(ConfigDbUrlEnv) {
+			configStore = newStore(ConfigDbUrlEnv, envInt(DbMaxRetriesEnv, defaultDbMaxRetries))
+		}
+		dbnames = newDbnameRegistry(metricsStore, configStore, os.Getenv(LogFedGroupEnv))
+		registerStats("dbnames", dbnames.stats)
+	}
 }
 
-func init() {
-	// Connect to postgresql
-	var err error
+// validates the connectivity to the metrics DBs and starts writing the metrics, it's called by main() before accepting requests.
+// A DB that is not reachable yet doesn't stop the drain, as the writes are retried (and spooled if enabled), but a fatal
+// error (e.g. the database does not exist) does, and so does an invalid sinks config.
+// The DBs are validated in parallel within the same startup timeout, so that the port is bound before the Heroku boot
+// timeout (R10) even if none of them is reachable.
+func startMetricsDB() error {
+	if metricsSinkErr != nil {
+		return metricsSinkErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration(DbStartupTimeoutEnv, defaultDbStartupTimeout))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(metricsWriters)+1)
 
-	dburl := os.Getenv(MetricsDbUrlEnv) + "?sslmode=require"
+	if metricsStore != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[0] = startPgwatch2MetricsDB(ctx)
+		}()
+	}
+
+	for i, bw := range metricsWriters {
+		if opener, ok := bw.sink.(sinkOpener); ok {
+			wg.Add(1)
+			go func(i int, opener sinkOpener) {
+				defer wg.Done()
+				errs[i+1] = opener.open(ctx)
+			}(i, opener)
+		}
+	}
+	wg.Wait()
 
-	u, err := url.Parse(dburl)
-	if err != nil {
-		fmt.Printf("Invalid metrics DB URL: %v\n", err)
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
 
-	if isEnv(DebugEnv) {
-		fmt.Printf("[db.go:init] metrics db url %v\n", u.Redacted())
+	for _, bw := range metricsWriters {
+		bw.start()
 	}
+	return nil
+}
 
-	db, err = sql.Open("postgres", dburl)
-	if err != nil {
-		fmt.Printf("Open DB error: %v\n", err)
+func startPgwatch2MetricsDB(ctx context.Context) error {
+	if err := metricsStore.waitReady(ctx); err != nil {
+		if classifyError(err) == errorFatal {
+			return err
+		}
+		fmt.Printf("Metrics DB not ready, starting anyway: %v\n", err)
 	}
 
-	err = db.Ping()
-	if err != nil {
-		fmt.Printf("Unable to ping DB: %v\n", err)
+	// the metric tables (and their partitions) are created by the pgwatch2 function of the storage schema
+	partitions.detectSchema(ctx, os.Getenv(StorageSchemaEnv))
+
+	// the samples are stored according to SOURCES (or the sources file) only, until drain_sources can be read
+	if sourcesDB != nil {
+		if err := sourcesDB.start(ctx); err != nil {
+			fmt.Printf("Unable to read drain_sources, using SOURCES only until it's available: %v\n", err)
+		}
 	}
 
-	cpuLoadInsertStmt, err = db.Prepare("INSERT into cpu_load(time, dbname, data) VALUES ($1, $2, $3);")
-	if err != nil {
-		fmt.Printf("Unable to create prepared stmt: %v\n", err)
+	partitions.start(envDuration(PartitionsPrecreateIntervalEnv, defaultPartitionsPrecreateInterval))
+	if retention != nil {
+		retention.start(envDuration(RetentionIntervalEnv, defaultRetentionInterval))
 	}
+	return nil
+}
 
-	herokuPgStatsInsertStmt, err = db.Prepare("INSERT into heroku_pg_stats(time, dbname, data) VALUES ($1, $2, $3);")
-	if err != nil {
-		fmt.Printf("Unable to create prepared stmt: %v\n", err)
+// writes the metrics still waiting in the batch writers and stops the metrics DB jobs, it's called by main() once
+// the ingest queue has been drained. The metrics not written by the shutdown deadline (ctx) are spooled.
+func stopMetricsDB(ctx context.Context) {
+	if metricsSink != nil {
+		_ = metricsSink.Close(ctx)
 	}
 
-	// The 3rd param ensures that there are always 2 partitions and that a new partition is created when the metric time is within the last partition
-	// for example, these are the current partitions:
-	// Partitions: subpartitions.cpu_load_y2024w17 FOR VALUES FROM ('2024-04-22 00:00:00+00') TO ('2024-04-29 00:00:00+00'),
-	// 			   subpartitions.cpu_load_y2024w18 FOR VALUES FROM ('2024-04-29 00:00:00+00') TO ('2024-05-06 00:00:00+00')
-	//
-	// it's 2024-04-30 and calling the admin.ensure_partition_metric_time() it will create the following partition
-	//
-	// Partitions: subpartitions.cpu_load_y2024w17 FOR VALUES FROM ('2024-04-22 00:00:00+00') TO ('2024-04-29 00:00:00+00'),
-	// 			   subpartitions.cpu_load_y2024w18 FOR VALUES FROM ('2024-04-29 00:00:00+00') TO ('2024-05-06 00:00:00+00'),
-	// 			   subpartitions.cpu_load_y2024w19 FOR VALUES FROM ('2024-05-06 00:00:00+00') TO ('2024-05-13 00:00:00+00')
-	//
-	// select * from admin.ensure_partition_metric_time($1 ==> metric name 'cpu_load', $2 ==> now(), $3 ==> 1)
-	initMetricsTableAndPartitionsSelectStmt, err = db.Prepare("select * from admin.ensure_partition_metric_time($1,$2, 1);")
-	if err != nil {
-		fmt.Printf("Unable to create prepared stmt: %v\n", err)
+	if metricsStore != nil {
+		partitions.close()
+		if retention != nil {
+			retention.close()
+		}
+		if sourcesDB != nil {
+			sourcesDB.close()
+		}
+		if dbnames != nil {
+			dbnames.close()
+		}
+		metricsStore.close()
 	}
 }
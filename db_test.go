@@ -3,16 +3,62 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 )
 
 func TestInsertCpuLoadMetrics(t *testing.T) {
 
-	var hpglog herokuPostgresLog
-	hpglog.loadavg1m = 0.54
-	hpglog.loadavg5m = 2.4
-	hpglog.loadavg15m = 5.4
+	hpglog := newHerokuPostgresLog(logMappings[PostgresProcId])
+	hpglog.values["load_1min"] = 0.54
+	hpglog.values["load_5min"] = 2.4
+	hpglog.values["load_15min"] = 5.4
 
-	insertCpuLoadMetrics(&hpglog, time.Now(), "PGWATCH2_MONITOREDDB_MYTARGETDB_URL")
+	if cld := hpglog.metricData()["cpu_load"]; len(cld) != 3 {
+		t.Errorf("unexpected cpu_load data %v", cld)
+	}
+
+	insertMetrics(hpglog, time.Now(), "PGWATCH2_MONITOREDDB_MYTARGETDB_URL")
+}
+
+// a sink whose DB is never reachable, open waits until the startup timeout
+type unreachableSink struct {
+	testSink
+}
+
+func (us *unreachableSink) open(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func TestStartMetricsDBTimeout(t *testing.T) {
+	t.Setenv(DbStartupTimeoutEnv, "100ms")
+
+	store, writers, sinkErr := metricsStore, metricsWriters, metricsSinkErr
+	defer func() { metricsStore, metricsWriters, metricsSinkErr = store, writers, sinkErr }()
+
+	metricsStore, metricsSinkErr = nil, nil
+	metricsWriters = []*batchWriter{newBatchWriter(&unreachableSink{}, 0, 0, 0), newBatchWriter(&unreachableSink{}, 0, 0, 0)}
+
+	start := time.Now()
+	if err := startMetricsDB(); err != nil {
+		t.Fatal(err)
+	}
+	// the sinks share the same startup timeout
+	if elapsed := time.Since(start); elapsed > 190*time.Millisecond {
+		t.Errorf("expected the sinks to be opened within the startup timeout, it took %v", elapsed)
+	}
+
+	for _, bw := range metricsWriters {
+		_ = bw.Close(context.Background())
+	}
+}
+
+func TestPgwatch2StoreEnvs(t *testing.T) {
+	t.Setenv(SourcesTableEnv, "")
+	t.Setenv(RetentionEnv, `{"*": "30d"}`)
+	if names := pgwatch2StoreEnvs(); len(names) < 2 || names[0] != SourcesTableEnv || names[len(names)-1] != RetentionEnv {
+		t.Errorf("unexpected env vars %v", names)
+	}
 }
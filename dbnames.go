@@ -0,0 +1,143 @@
+// reference(s):
+// 	https://github.com/cybertec-postgresql/pgwatch2/blob/master/pgwatch2/sql/metric_store/00_schema_base.sql
+// 	https://github.com/cybertec-postgresql/pgwatch2/blob/master/pgwatch2/sql/config_store/config_store.sql
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// when set, the monitored db names written by the drain (configured or discovered) are added to
+// admin.all_distinct_dbname_metrics, which the Grafana dashboards use to list the dbnames of each metric
+const RegisterDbnamesEnv string = "HKPG_LOGDRAIN_REGISTER_DBNAMES"
+
+// when set, the monitored db names are also added to the pgwatch2.monitored_db table of the config DB.
+// pgwatch2 can't poll them, as they are fed by the logs, so they are disabled and put in their own group.
+const ConfigDbUrlEnv string = "PGWATCH2_CONFIG_URL"
+const LogFedGroupEnv string = "HKPG_LOGDRAIN_LOG_FED_GROUP"
+
+const defaultLogFedGroup string = "heroku-logdrain"
+
+const registerDbnameMetricQuery string = "insert into admin.all_distinct_dbname_metrics (dbname, metric) values ($1, $2) on conflict do nothing;"
+
+// md_hostname, md_dbname and md_user are mandatory, but they are not used as the db is not polled
+const registerMonitoredDbQuery string = `insert into pgwatch2.monitored_db (md_unique_name, md_hostname, md_dbname, md_user, md_is_enabled, md_group, md_custom_tags)
+values ($1, 'logdrain', $1, 'logdrain', false, $2, '{"log_fed": "true"}') on conflict (md_unique_name) do nothing;`
+
+// dbnameRegistry adds each monitored db name to the pgwatch2 listing tables the first time its rows are written.
+// A failed insert is tried again with the next rows.
+type dbnameRegistry struct {
+	store       *store
+	configStore *store // nil if the config DB is not set
+	group       string
+
+	mu         sync.Mutex
+	registered map[string]bool // dbname/metric -> registered in admin.all_distinct_dbname_metrics
+	monitored  map[string]bool // dbname -> registered in pgwatch2.monitored_db
+
+	// the inserts, so that mu is not held across them
+	flights flightGroup
+
+	failures atomic.Int64
+}
+
+func newDbnameRegistry(store *store, configStore *store, group string) *dbnameRegistry {
+	if group == "" {
+		group = defaultLogFedGroup
+	}
+
+	dr := &dbnameRegistry{
+		store:       store,
+		configStore: configStore,
+		group:       group,
+		registered:  make(map[string]bool),
+		monitored:   make(map[string]bool),
+	}
+
+	store.prepare("register dbname metric", registerDbnameMetricQuery)
+	if configStore != nil {
+		configStore.prepare("register monitored db", registerMonitoredDbQuery)
+	}
+	return dr
+}
+
+// registers the dbnames of the rows written into metric
+func (dr *dbnameRegistry) register(ctx context.Context, metric string, rows []metricRow) {
+	dbnames := make(map[string]bool)
+	for _, row := range rows {
+		dbnames[row.dbname] = true
+	}
+
+	for dbname := range dbnames {
+		err := dr.once(ctx, "all_distinct_dbname_metrics", dr.registered, dbname+"/"+metric, func() error {
+			return dr.store.exec(ctx, "register dbname metric", dbname, metric)
+		})
+		if err != nil {
+			fmt.Printf("DB error: unable to register dbname %v of %v: %v\n", dbname, metric, err)
+		}
+
+		if dr.configStore == nil {
+			continue
+		}
+		err = dr.once(ctx, "monitored_db", dr.monitored, dbname, func() error {
+			err := dr.configStore.exec(ctx, "register monitored db", dbname, dr.group)
+			if err == nil && isEnv(DebugEnv) {
+				fmt.Printf("[dbnames.go:register] monitored db %v registered in group %v\n", dbname, dr.group)
+			}
+			return err
+		})
+		if err != nil {
+			fmt.Printf("config DB error: unable to register monitored db %v: %v\n", dbname, err)
+		}
+	}
+}
+
+// runs insert unless key is already in registered, dr.mu is not held across it and a single insert is in flight for each key
+func (dr *dbnameRegistry) once(ctx context.Context, table string, registered map[string]bool, key string, insert func() error) error {
+	isRegistered := func() bool {
+		dr.mu.Lock()
+		defer dr.mu.Unlock()
+		return registered[key]
+	}
+
+	if isRegistered() {
+		return nil
+	}
+
+	return dr.flights.do(ctx, table+":"+key, func() error {
+		if isRegistered() {
+			return nil
+		}
+
+		if err := insert(); err != nil {
+			dr.failures.Add(1)
+			return err
+		}
+
+		dr.mu.Lock()
+		registered[key] = true
+		dr.mu.Unlock()
+		return nil
+	})
+}
+
+func (dr *dbnameRegistry) stats() interface{} {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	return map[string]interface{}{
+		"registered": len(dr.registered),
+		"monitored":  len(dr.monitored),
+		"failures":   dr.failures.Load(),
+	}
+}
+
+func (dr *dbnameRegistry) close() {
+	if dr.configStore != nil {
+		dr.configStore.close()
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDbnameRegistry(t *testing.T) {
+	t.Setenv("HKPG_LOGDRAIN_TEST_DB_URL", "postgres://localhost:1/metrics")
+	store := newStore("HKPG_LOGDRAIN_TEST_DB_URL", 0)
+	dr := newDbnameRegistry(store, store, "")
+
+	rows := append(newTestRows("heroku_pg_stats", 3), newTestRows("heroku_pg_stats", 1)...)
+	rows[3].dbname = "other"
+
+	// already registered, no insert
+	dr.registered[rows[0].dbname+"/heroku_pg_stats"] = true
+	dr.monitored[rows[0].dbname] = true
+	dr.register(context.Background(), "heroku_pg_stats", rows[:3])
+	if dr.failures.Load() != 0 {
+		t.Errorf("expected the registered dbname not to be inserted again, got %v failures", dr.failures.Load())
+	}
+
+	// the DB is not reachable, both inserts of the new dbname fail and are tried again with the next rows
+	for i := 1; i <= 2; i++ {
+		dr.register(context.Background(), "heroku_pg_stats", rows)
+		if dr.failures.Load() != int64(2*i) || dr.registered["other/heroku_pg_stats"] || dr.monitored["other"] {
+			t.Errorf("unexpected failures %v registered %v", dr.failures.Load(), dr.registered)
+		}
+	}
+}
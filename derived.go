@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// when set, derived fields (utilization percentages and headroom) are computed at ingest time and stored next to
+// the raw values, so that dashboards don't need to compute them
+const DerivedMetricsEnv string = "HKPG_LOGDRAIN_DERIVED_METRICS"
+
+// the max connections of each source, used for the connection saturation, e.g. {"DATABASE": 500, "DATABASE_ONYX": 120}
+const ConnectionLimitsEnv string = "HKPG_LOGDRAIN_CONNECTION_LIMITS"
+
+// the metric the derived fields are added to
+const derivedMetric string = "heroku_pg_stats"
+
+var connectionLimits = loadConnectionLimits()
+
+func loadConnectionLimits() map[string]int64 {
+	limits := make(map[string]int64)
+
+	if v, ok := os.LookupEnv(ConnectionLimitsEnv); ok {
+		if err := json.Unmarshal([]byte(v), &limits); err != nil {
+			fmt.Printf("invalid %v value[%v], connection saturation disabled: %v\n", ConnectionLimitsEnv, v, err)
+			return make(map[string]int64)
+		}
+	}
+	return limits
+}
+
+// adds to data the fields derived from the samples of rl, a field is omitted if any of its samples is missing
+func addDerivedFields(rl *herokuPostgresLog, data map[string]interface{}, limits map[string]int64) {
+	total, okTotal := rl.floatValue("memorytotal")
+	free, okFree := rl.floatValue("memoryfree")
+	cached, okCached := rl.floatValue("memorycached")
+	postgres, okPostgres := rl.floatValue("memorypostgres")
+
+	if okTotal && total > 0 {
+		// memory-free doesn't include the page cache
+		if okFree && okCached {
+			data["memoryusedpercentage"] = (total - free - cached) / total * 100
+		}
+		if okCached && okPostgres {
+			data["memorycachedpostgrespercentage"] = (cached + postgres) / total * 100
+		}
+	}
+
+	used, okUsed := rl.floatValue("tmpdiskused")
+	available, okAvailable := rl.floatValue("tmpdiskavailable")
+	if okUsed && okAvailable && used+available > 0 {
+		data["tmpdiskusedpercentage"] = used / (used + available) * 100
+	}
+
+	if active, ok := rl.floatValue("activeconnections"); ok {
+		if limit, ok := limits[rl.source]; ok && limit > 0 {
+			data["connectionsaturationpercentage"] = active / float64(limit) * 100
+		}
+	}
+
+	// wal-percentage-used is between 0.0 and 1.0
+	if wal, ok := rl.floatValue("walpercentageused"); ok {
+		data["walheadroompercentage"] = (1 - wal) * 100
+	}
+}
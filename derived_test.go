@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddDerivedFields(t *testing.T) {
+	rl := parseTestLogLine(t, testHerokuPostgresLogLine)
+
+	data := make(map[string]interface{})
+	addDerivedFields(rl, data, map[string]int64{"DATABASE": 60})
+
+	expected := map[string]float64{
+		"memoryusedpercentage":           float64(3944484-74980-2984436) / 3944484 * 100,
+		"memorycachedpostgrespercentage": float64(2984436+33960) / 3944484 * 100,
+		"tmpdiskusedpercentage":          543633408.0 / (543633408 + 72435159040) * 100,
+		"connectionsaturationpercentage": 25,
+		"walheadroompercentage":          (1 - 0.06650439708481809) * 100,
+	}
+	for field, v := range expected {
+		if got, ok := data[field].(float64); !ok || math.Abs(got-v) > 1e-9 {
+			t.Errorf("unexpected %v[%v], expected %v", field, data[field], v)
+		}
+	}
+
+	// no limit for the source and missing samples
+	rl = parseTestLogLine(t, "source=DATABASE_ONYX sample#active-connections=15 sample#memory-total=3944484kB")
+	data = make(map[string]interface{})
+	addDerivedFields(rl, data, map[string]int64{"DATABASE": 60})
+	if len(data) != 0 {
+		t.Errorf("unexpected derived fields %v", data)
+	}
+}
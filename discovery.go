@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// when set, the log lines of a database without a source rule are stored with a monitored db name built from this
+// template instead of being dropped, e.g. {{app}}_{{addon}}. The placeholders are {{app}}, {{drain_token}}, {{addon}},
+// {{source}}, {{hostname}} and {{name}}.
+// The metric tables and their partitions are shared by all the monitored dbs, so a discovered one only needs the
+// partitions that are already created on demand by the pgwatch2 sink.
+const AutoDiscoveryTemplateEnv string = "HKPG_LOGDRAIN_AUTODISCOVERY_TEMPLATE"
+
+// the app name of each drain token, used for the {{app}} placeholder, e.g. {"d.01234567-89ab-cdef-0123-456789abcdef": "myapp"}.
+// Log lines don't carry the app name, so {{app}} is the drain token for the drains without an app name.
+const DrainAppsEnv string = "HKPG_LOGDRAIN_DRAIN_APPS"
+
+// the characters not allowed in a discovered monitored db name
+var dbnameInvalidCharsRegexp = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+var discoveryPlaceholders = []string{"{{app}}", "{{drain_token}}", "{{addon}}", "{{source}}", "{{hostname}}", "{{name}}"}
+
+type discoveredSource struct {
+	DrainToken string    `json:"drain_token,omitempty"`
+	Addon      string    `json:"addon,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Dbname     string    `json:"dbname"`
+	FirstSeen  time.Time `json:"first_seen"`
+}
+
+// sourceDiscovery resolves the monitored db name of the log lines without a source rule and keeps track of them
+type sourceDiscovery struct {
+	template string // empty if auto-discovery is disabled
+	apps     map[string]string
+
+	mu         sync.Mutex
+	discovered map[string]*discoveredSource // drain token/addon/source -> discovered source
+	unmatched  map[string]int64             // drain token/addon/source -> log lines dropped
+}
+
+var discovery = loadSourceDiscovery()
+
+func newSourceDiscovery(template string, apps map[string]string) (*sourceDiscovery, error) {
+	if template != "" {
+		rest := template
+		for _, placeholder := range discoveryPlaceholders {
+			rest = strings.ReplaceAll(rest, placeholder, "")
+		}
+		if strings.Contains(rest, "{{") || rest == template {
+			return nil, fmt.Errorf("invalid template[%v], the placeholders are %v", template, discoveryPlaceholders)
+		}
+	}
+
+	return &sourceDiscovery{
+		template:   template,
+		apps:       apps,
+		discovered: make(map[string]*discoveredSource),
+		unmatched:  make(map[string]int64),
+	}, nil
+}
+
+func loadSourceDiscovery() *sourceDiscovery {
+	apps := make(map[string]string)
+	if v, ok := os.LookupEnv(DrainAppsEnv); ok {
+		if err := json.Unmarshal([]byte(v), &apps); err != nil {
+			fmt.Printf("invalid %v value[%v], drain tokens used as app names: %v\n", DrainAppsEnv, v, err)
+			apps = make(map[string]string)
+		}
+	}
+
+	d, err := newSourceDiscovery(os.Getenv(AutoDiscoveryTemplateEnv), apps)
+	if err != nil {
+		fmt.Printf("auto-discovery disabled: %v\n", err)
+		d, _ = newSourceDiscovery("", apps)
+	}
+	return d
+}
+
+// returns the monitored db name built from the template for a log line without a source rule.
+// A log line is dropped (and counted) if auto-discovery is disabled or the template refers to a value it doesn't have.
+func (d *sourceDiscovery) resolve(rl *herokuPostgresLog, t time.Time) (string, bool) {
+	key := rl.drainToken + "/" + rl.addon + "/" + rl.source
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if ds, ok := d.discovered[key]; ok {
+		return ds.Dbname, true
+	}
+
+	dbname, ok := d.dbname(rl)
+	if !ok {
+		d.unmatched[key]++
+		if d.unmatched[key] == 1 {
+			fmt.Printf("no monitored db for drain token[%v] addon[%v] source[%v], its samples are dropped\n", rl.drainToken, rl.addon, rl.source)
+		}
+		return "", false
+	}
+
+	d.discovered[key] = &discoveredSource{DrainToken: rl.drainToken, Addon: rl.addon, Source: rl.source, Dbname: dbname, FirstSeen: t}
+	fmt.Printf("discovered drain token[%v] addon[%v] source[%v], monitored db name[%v]\n", rl.drainToken, rl.addon, rl.source, dbname)
+	return dbname, true
+}
+
+func (d *sourceDiscovery) dbname(rl *herokuPostgresLog) (string, bool) {
+	if d.template == "" {
+		return "", false
+	}
+
+	app := d.apps[rl.drainToken]
+	if app == "" {
+		app = rl.drainToken
+	}
+
+	values := []string{app, rl.drainToken, rl.addon, rl.source, rl.hostname, rl.name}
+	oldnew := make([]string, 0, 2*len(values))
+	for i, v := range values {
+		if strings.Contains(d.template, discoveryPlaceholders[i]) && v == "" {
+			return "", false
+		}
+		oldnew = append(oldnew, discoveryPlaceholders[i], v)
+	}
+
+	dbname := strings.NewReplacer(oldnew...).Replace(d.template)
+	dbname = dbnameInvalidCharsRegexp.ReplaceAllString(strings.ToLower(dbname), "_")
+	return dbname, dbname != ""
+}
+
+func (d *sourceDiscovery) stats() interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	discovered := make([]discoveredSource, 0, len(d.discovered))
+	for _, ds := range d.discovered {
+		discovered = append(discovered, *ds)
+	}
+	sort.Slice(discovered, func(i, j int) bool { return discovered[i].Dbname < discovered[j].Dbname })
+
+	unmatched := make(map[string]int64, len(d.unmatched))
+	for key, n := range d.unmatched {
+		unmatched[key] = n
+	}
+
+	return map[string]interface{}{"enabled": d.template != "", "discovered": discovered, "unmatched": unmatched}
+}
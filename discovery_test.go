@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourceDiscoveryResolve(t *testing.T) {
+	d, err := newSourceDiscovery("{{app}}_{{addon}}", map[string]string{"d.app1": "My-App"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl := parseTestLogLine(t, testHerokuPostgresLogLine)
+	rl.drainToken = "d.app1"
+	if dbname, ok := d.resolve(rl, time.Now()); !ok || dbname != "my-app_postgresql-defined-24903" {
+		t.Errorf("unexpected dbname[%v] ok[%v]", dbname, ok)
+	}
+
+	// the drain token is the app name of a drain without an app name
+	rl.drainToken = "d.app2"
+	if dbname, ok := d.resolve(rl, time.Now()); !ok || dbname != "d_app2_postgresql-defined-24903" {
+		t.Errorf("unexpected dbname[%v] ok[%v]", dbname, ok)
+	}
+
+	// the template refers to a value the log line doesn't have
+	rl = parseTestLogLine(t, "source=DATABASE sample#tables=4")
+	if _, ok := d.resolve(rl, time.Now()); ok {
+		t.Errorf("expected a log line without addon to be dropped")
+	}
+
+	if len(d.discovered) != 2 || len(d.unmatched) != 1 {
+		t.Errorf("unexpected discovered %v unmatched %v", d.discovered, d.unmatched)
+	}
+
+	if _, err := newSourceDiscovery("{{database}}", nil); err == nil {
+		t.Errorf("expected an error for an unknown placeholder")
+	}
+}
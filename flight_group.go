@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup runs a single call at a time for each key, the callers of a key already in flight wait for that call and
+// get its error. It's used instead of holding a mutex across the DB calls, so that the callers of other keys (e.g. the
+// other metrics) are not blocked while a call is retried during a DB outage.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+// runs fn unless a call of key is in flight, a waiting caller stops waiting once its ctx is done
+func (g *flightGroup) do(ctx context.Context, key string, fn func() error) error {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+
+	return c.err
+}
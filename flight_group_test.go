@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls atomic.Int64
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = g.do(context.Background(), "heroku_pg_stats", func() error {
+				calls.Add(1)
+				<-release
+				return errors.New("unreachable")
+			})
+		}(i)
+	}
+
+	// another key is not blocked by the call in flight
+	done := make(chan struct{})
+	go func() {
+		_ = g.do(context.Background(), "cpu_load", func() error { return nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the call of another key not to wait")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected a single call in flight, got %v", calls.Load())
+	}
+	for _, err := range errs {
+		if err == nil {
+			t.Errorf("expected the waiting callers to get the error of the call")
+		}
+	}
+}
@@ -8,3 +8,5 @@ require (
 )
 
 require github.com/lib/pq v1.10.9
+
+require github.com/golang/snappy v0.0.4
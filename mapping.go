@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// the mapping can be extended (or its built-in samples overridden) without a code change, either with a JSON
+// document in HKPG_LOGDRAIN_MAPPING or with the path of a JSON file in HKPG_LOGDRAIN_MAPPING_FILE, e.g.
+// {"heroku-postgres": [{"key": "sample#max-connections", "type": "int", "field": "maxconnections", "metrics": ["heroku_pg_stats"]}]}
+const MappingEnv string = "HKPG_LOGDRAIN_MAPPING"
+const MappingFileEnv string = "HKPG_LOGDRAIN_MAPPING_FILE"
+
+const (
+	SampleTypeInt   string = "int"
+	SampleTypeFloat string = "float"
+)
+
+// how a logfmt key of a log line is parsed and where its value is stored
+type sampleMapping struct {
+	Key     string   `json:"key"`            // logfmt key, e.g. sample#db_size
+	Type    string   `json:"type"`           // int or float
+	Unit    string   `json:"unit,omitempty"` // suffix removed before parsing, e.g. bytes or kB
+	Field   string   `json:"field"`          // JSON field of the metric data, e.g. dbsize
+	Metrics []string `json:"metrics"`        // pgwatch2 metrics the value is written to, e.g. heroku_pg_stats
+}
+
+// the l2met prefixes of the keys with a value (see https://github.com/ryandotsmith/l2met/wiki/Usage#logging-convention)
+var l2metPrefixes = []string{"sample#", "count#", "measure#"}
+
+// procid -> catch-all metric the l2met keys without a mapping are written to, so that new samples added by Heroku
+// are stored without a release (and the mapping can be extended later on)
+var extraMetrics = map[string]string{
+	PostgresProcId: "heroku_pg_extra",
+}
+
+// procid (e.g. heroku-postgres) -> its samples, keyed by logfmt key
+type logMapping map[string]map[string]*sampleMapping
+
+// the log lines of all the other procids are ignored
+var logMappings = loadLogMapping()
+
+// the built-in Heroku Postgres mapping, see https://devcenter.heroku.com/articles/heroku-postgres-metrics-logs
+var defaultLogMapping = map[string][]sampleMapping{
+	PostgresProcId: {
+		{Key: "sample#current_transaction", Type: SampleTypeInt, Field: "currenttransaction", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#db_size", Type: SampleTypeInt, Unit: "bytes", Field: "dbsize", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#tables", Type: SampleTypeInt, Field: "tables", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#active-connections", Type: SampleTypeInt, Field: "activeconnections", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#waiting-connections", Type: SampleTypeInt, Field: "waitingconnections", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#index-cache-hit-rate", Type: SampleTypeFloat, Field: "indexcachehitrate", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#table-cache-hit-rate", Type: SampleTypeFloat, Field: "tablecachehitrate", Metrics: []string{"heroku_pg_stats"}},
+		// TODO: cpu_load to be removed
+		{Key: "sample#load-avg-1m", Type: SampleTypeFloat, Field: "load_1min", Metrics: []string{"heroku_pg_stats", "cpu_load"}},
+		{Key: "sample#load-avg-5m", Type: SampleTypeFloat, Field: "load_5min", Metrics: []string{"heroku_pg_stats", "cpu_load"}},
+		{Key: "sample#load-avg-15m", Type: SampleTypeFloat, Field: "load_15min", Metrics: []string{"heroku_pg_stats", "cpu_load"}},
+		{Key: "sample#read-iops", Type: SampleTypeFloat, Field: "readiops", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#write-iops", Type: SampleTypeFloat, Field: "writeiops", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#tmp-disk-used", Type: SampleTypeInt, Field: "tmpdiskused", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#tmp-disk-available", Type: SampleTypeInt, Field: "tmpdiskavailable", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#memory-total", Type: SampleTypeInt, Unit: "kB", Field: "memorytotal", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#memory-free", Type: SampleTypeInt, Unit: "kB", Field: "memoryfree", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#memory-cached", Type: SampleTypeInt, Unit: "kB", Field: "memorycached", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#memory-postgres", Type: SampleTypeInt, Unit: "kB", Field: "memorypostgres", Metrics: []string{"heroku_pg_stats"}},
+		{Key: "sample#wal-percentage-used", Type: SampleTypeFloat, Field: "walpercentageused", Metrics: []string{"heroku_pg_stats"}},
+	},
+}
+
+// merges the mapping config into the built-in mapping, a sample with the same key of a built-in one replaces it
+func buildLogMapping(config map[string][]sampleMapping) (logMapping, error) {
+	m := make(logMapping)
+
+	for _, mappings := range []map[string][]sampleMapping{defaultLogMapping, config} {
+		for procid, samples := range mappings {
+			if m[procid] == nil {
+				m[procid] = make(map[string]*sampleMapping)
+			}
+			for i := range samples {
+				sm := samples[i]
+				if err := sm.validate(); err != nil {
+					return nil, fmt.Errorf("procid %v: %w", procid, err)
+				}
+				m[procid][sm.Key] = &sm
+			}
+		}
+	}
+
+	return m, m.validate()
+}
+
+func (sm *sampleMapping) validate() error {
+	if sm.Key == "" || sm.Field == "" {
+		return fmt.Errorf("key and field are required: %+v", *sm)
+	}
+	if sm.Type != SampleTypeInt && sm.Type != SampleTypeFloat {
+		return fmt.Errorf("%v: invalid type[%v], it must be %v or %v", sm.Key, sm.Type, SampleTypeInt, SampleTypeFloat)
+	}
+	if len(sm.Metrics) == 0 {
+		return fmt.Errorf("%v: at least one metric is required", sm.Key)
+	}
+	return nil
+}
+
+// two keys of a procid can't be mapped to the same field, even of different metrics, as the values of a log line are
+// held by field (see herokuPostgresLog.values)
+func (m logMapping) validate() error {
+	for procid, samples := range m {
+		fields := make(map[string]string)
+		for _, sm := range samples {
+			if key, ok := fields[sm.Field]; ok && key != sm.Key {
+				return fmt.Errorf("procid %v: %v and %v are both mapped to the %v field", procid, key, sm.Key, sm.Field)
+			}
+			fields[sm.Field] = sm.Key
+		}
+	}
+	return nil
+}
+
+// returns all the metrics the mapping writes to, the catch-all ones included, sorted
+func (m logMapping) metrics() []string {
+	set := make(map[string]bool)
+	for procid, samples := range m {
+		if metric, ok := extraMetrics[procid]; ok {
+			set[metric] = true
+		}
+
+		for _, sm := range samples {
+			for _, metric := range sm.Metrics {
+				set[metric] = true
+			}
+		}
+	}
+
+	metrics := make([]string, 0, len(set))
+	for metric := range set {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	return metrics
+}
+
+// reads the mapping config from the env (or the file it points to), the built-in mapping is used if it's not valid
+func loadLogMapping() logMapping {
+	var raw []byte
+	if path, ok := os.LookupEnv(MappingFileEnv); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("unable to read mapping file %v: %v\n", path, err)
+		}
+		raw = b
+	} else if v, ok := os.LookupEnv(MappingEnv); ok {
+		raw = []byte(v)
+	}
+
+	var config map[string][]sampleMapping
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			fmt.Printf("invalid mapping config, using the built-in mapping: %v\n", err)
+			config = nil
+		}
+	}
+
+	m, err := buildLogMapping(config)
+	if err != nil {
+		fmt.Printf("invalid mapping config, using the built-in mapping: %v\n", err)
+		m, _ = buildLogMapping(nil)
+	}
+
+	if isEnv(DebugEnv) {
+		fmt.Printf("[mapping.go:loadLogMapping] procids[%v] metrics[%v]\n", len(m), m.metrics())
+	}
+	return m
+}
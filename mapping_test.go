@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBuildLogMapping(t *testing.T) {
+	var config map[string][]sampleMapping
+	err := json.Unmarshal([]byte(`{
+		"heroku-postgres": [
+			{"key": "sample#max-connections", "type": "int", "field": "maxconnections", "metrics": ["heroku_pg_stats"]},
+			{"key": "sample#db_size", "type": "float", "unit": "bytes", "field": "dbsize", "metrics": ["db_size"]}
+		],
+		"heroku-redis": [
+			{"key": "sample#memory-redis", "type": "int", "unit": "bytes", "field": "memoryredis", "metrics": ["heroku_redis_stats"]}
+		]
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := buildLogMapping(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sm := m[PostgresProcId]["sample#max-connections"]; sm == nil || sm.Field != "maxconnections" {
+		t.Errorf("expected the sample to be added, got %+v", sm)
+	}
+	if sm := m[PostgresProcId]["sample#db_size"]; sm == nil || sm.Type != SampleTypeFloat || sm.Metrics[0] != "db_size" {
+		t.Errorf("expected the built-in sample to be replaced, got %+v", sm)
+	}
+	if sm := m[PostgresProcId]["sample#tables"]; sm == nil {
+		t.Errorf("expected the built-in samples to be kept")
+	}
+	if m["heroku-redis"] == nil {
+		t.Errorf("expected the heroku-redis procid to be added")
+	}
+
+	rl := newHerokuPostgresLog(m[PostgresProcId])
+	_ = rl.HandleLogfmt([]byte("sample#db_size"), []byte("1.5bytes"))
+	if v, ok := rl.floatValue("dbsize"); !ok || v != 1.5 || rl.metricData()["db_size"] == nil {
+		t.Errorf("unexpected dbsize %v %v", v, ok)
+	}
+}
+
+func TestBuildLogMappingInvalid(t *testing.T) {
+	configs := []map[string][]sampleMapping{
+		{PostgresProcId: {{Key: "sample#x", Type: "string", Field: "x", Metrics: []string{"heroku_pg_stats"}}}},
+		{PostgresProcId: {{Key: "sample#x", Type: SampleTypeInt, Field: "x"}}},
+		{PostgresProcId: {{Key: "sample#x", Type: SampleTypeInt, Field: "dbsize", Metrics: []string{"heroku_pg_stats"}}}},
+		// the same field of another metric, its value would be written under the metrics of sample#db_size
+		{PostgresProcId: {{Key: "sample#x", Type: SampleTypeInt, Field: "dbsize", Metrics: []string{"heroku_pg_extra_size"}}}},
+	}
+
+	for _, config := range configs {
+		if _, err := buildLogMapping(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
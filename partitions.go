@@ -0,0 +1,503 @@
+// reference(s):
+// 	https://github.com/cybertec-postgresql/pgwatch2/blob/master/pgwatch2/sql/metric_store/metric-time/ensure_partition_metric_time.sql
+// 	https://github.com/cybertec-postgresql/pgwatch2/blob/master/pgwatch2/sql/metric_store/metric-dbname-time/ensure_partition_metric_dbname_time.sql
+// 	https://github.com/cybertec-postgresql/pgwatch2/blob/master/pgwatch2/sql/metric_store/00_schema_base.sql
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PartitionsPrecreateIntervalEnv string = "HKPG_LOGDRAIN_PARTITIONS_PRECREATE_INTERVAL"
+
+// the pgwatch2 storage schema is read from admin.storage_schema_type at startup (or before the first partition is
+// ensured if the metrics DB is not reachable yet), unless it's set here
+const StorageSchemaEnv string = "HKPG_LOGDRAIN_STORAGE_SCHEMA"
+
+const defaultPartitionsPrecreateInterval time.Duration = time.Hour
+
+// The 3rd param ensures that there are always 2 partitions and that a new partition is created when the metric time is within the last partition
+// for example, these are the current partitions:
+// Partitions: subpartitions.cpu_load_y2024w17 FOR VALUES FROM ('2024-04-22 00:00:00+00') TO ('2024-04-29 00:00:00+00'),
+// 			   subpartitions.cpu_load_y2024w18 FOR VALUES FROM ('2024-04-29 00:00:00+00') TO ('2024-05-06 00:00:00+00')
+//
+// it's 2024-04-30 and calling the admin.ensure_partition_metric_time() it will create the following partition
+//
+// Partitions: subpartitions.cpu_load_y2024w17 FOR VALUES FROM ('2024-04-22 00:00:00+00') TO ('2024-04-29 00:00:00+00'),
+// 			   subpartitions.cpu_load_y2024w18 FOR VALUES FROM ('2024-04-29 00:00:00+00') TO ('2024-05-06 00:00:00+00'),
+// 			   subpartitions.cpu_load_y2024w19 FOR VALUES FROM ('2024-05-06 00:00:00+00') TO ('2024-05-13 00:00:00+00')
+//
+// select * from admin.ensure_partition_metric_time($1 ==> metric name 'cpu_load', $2 ==> now(), $3 ==> 1)
+
+// it returns the range covered by the available partitions (part_available_from, part_available_to)
+const ensurePartitionQuery string = "select * from admin.ensure_partition_metric_time($1,$2, 1);"
+const partitionExistsQuery string = "select to_regclass($1) is not null;"
+
+// the same for the partitions of a single dbname, in the "metric-dbname-time" storage schema
+const ensureDbnamePartitionQuery string = "select * from admin.ensure_partition_metric_dbname_time($1, $2, $3, 1);"
+
+// the non partitioned storage schemas only need the metric table to be created once
+const ensureMetricTableQuery string = "select admin.ensure_dummy_metrics_table($1);"
+const ensureTimescaleQuery string = "select admin.ensure_partition_timescale($1);"
+
+const storageSchemaQuery string = "select schema_type from admin.storage_schema_type;"
+
+// the pgwatch2 storage schemas (admin.storage_schema_type), they all have the same metric tables columns
+const (
+	StorageSchemaMetric           string = "metric"             // a table per metric
+	StorageSchemaMetricTime       string = "metric-time"        // a table per metric, weekly partitions
+	StorageSchemaMetricDbnameTime string = "metric-dbname-time" // a table per metric, a partition per dbname, weekly sub-partitions
+	StorageSchemaTimescale        string = "timescale"          // a hypertable per metric
+	StorageSchemaCustom           string = "custom"             // tables created by the user, nothing to ensure
+)
+
+// how many of the last created partitions are reported by /stats
+const partitionsReported int = 50
+
+// pgwatch2 "metric-time" partitions are weekly, starting on Monday 00:00 UTC
+const partitionWeek time.Duration = 7 * 24 * time.Hour
+
+type partitionRange struct {
+	Name string    `json:"name"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// the partition of a metric a row is written to, dbname is only set in the "metric-dbname-time" storage schema and
+// week is zero in the storage schemas without weekly partitions
+type partitionKey struct {
+	dbname string
+	week   time.Time
+}
+
+// partitionManager makes sure that the weekly partition of a metric exists before any sample of that week is written.
+// It remembers the weeks already ensured for each metric so that admin.ensure_partition_metric_time is only called
+// for a week not seen yet (e.g. a dyno running across the week boundary or a late sample), and it pre-creates the
+// partitions of the current and next week on a schedule.
+// The pgwatch2 function called depends on the storage schema, see detectSchema.
+type partitionManager struct {
+	store *store
+	// the storage schema names of admin.storage_schema_type that are not pgwatch2 ones -> the pgwatch2 storage schema
+	// handled the same way, e.g. those of pgwatch v3
+	aliases map[string]string
+
+	mu       sync.Mutex
+	schema   string
+	override string                           // the storage schema set by the env, if any
+	detected bool                             // whether schema has been read (or set), until then no partition is ensured
+	ensured  map[string]map[partitionKey]bool // metric name -> partition -> ensured
+	created  []partitionRange
+
+	// the DB calls ensuring a partition, so that pm.mu is not held across them
+	flights flightGroup
+
+	createdCount atomic.Int64
+	failedCount  atomic.Int64
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPartitionManager(store *store, metrics ...string) *partitionManager {
+	pm := &partitionManager{
+		store:   store,
+		schema:  StorageSchemaMetricTime,
+		ensured: make(map[string]map[partitionKey]bool),
+		stopCh:  make(chan struct{}),
+	}
+
+	// the metrics to pre-create partitions for, others are added as their samples are received
+	for _, metric := range metrics {
+		pm.ensured[metric] = make(map[partitionKey]bool)
+	}
+	return pm
+}
+
+// sets the storage schema to override or, if it's empty, to the one read from admin.storage_schema_type.
+// The current storage schema is kept if it's not valid or if admin.storage_schema_type doesn't exist, e.g. on a metrics
+// DB created before pgwatch2 had it. If the metrics DB is not reachable yet, the storage schema is read by ensure instead,
+// as using the wrong pgwatch2 function for the life of the dyno would fail every write.
+func (pm *partitionManager) detectSchema(ctx context.Context, override string) {
+	pm.mu.Lock()
+	pm.override = override
+	pm.mu.Unlock()
+
+	if err := pm.readSchema(ctx); err != nil {
+		fmt.Printf("DB error: unable to read the storage schema, it will be read before the first partition is ensured: %v\n", err)
+	}
+}
+
+// returns an error only if the storage schema can be read later on, i.e. on a transient error
+func (pm *partitionManager) readSchema(ctx context.Context) error {
+	pm.mu.Lock()
+	current, schema := pm.schema, pm.override
+	pm.mu.Unlock()
+
+	if schema == "" {
+		err := pm.store.withRetry(ctx, "storage schema", func(db *sql.DB) error {
+			return db.QueryRowContext(ctx, storageSchemaQuery).Scan(&schema)
+		})
+		if err != nil {
+			if class := classifyError(err); class == errorRetryable || class == errorReconnect {
+				return err
+			}
+			fmt.Printf("DB error: unable to read the storage schema, using %v: %v\n", current, err)
+			pm.setDetected()
+			return nil
+		}
+	}
+
+	name := schema
+	if alias, ok := pm.aliases[schema]; ok {
+		schema = alias
+	}
+
+	if err := pm.setSchema(schema); err != nil {
+		fmt.Printf("%v, using %v\n", err, current)
+		pm.setDetected()
+		return nil
+	}
+	fmt.Printf("metrics DB storage schema %v (%v)\n", name, schema)
+	return nil
+}
+
+func (pm *partitionManager) setDetected() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.detected = true
+}
+
+// reads the storage schema if it has not been read yet, a single read is in flight
+func (pm *partitionManager) ensureSchema(ctx context.Context) error {
+	pm.mu.Lock()
+	detected := pm.detected
+	pm.mu.Unlock()
+
+	if detected {
+		return nil
+	}
+
+	return pm.flights.do(ctx, "storage schema", func() error {
+		pm.mu.Lock()
+		detected := pm.detected
+		pm.mu.Unlock()
+
+		if detected {
+			return nil
+		}
+		return pm.readSchema(ctx)
+	})
+}
+
+func (pm *partitionManager) setSchema(schema string) error {
+	switch schema {
+	case StorageSchemaMetric, StorageSchemaMetricTime, StorageSchemaMetricDbnameTime, StorageSchemaTimescale, StorageSchemaCustom:
+	default:
+		return fmt.Errorf("unsupported storage schema %v", schema)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.schema = schema
+	pm.detected = true
+	for metric := range pm.ensured {
+		pm.ensured[metric] = make(map[partitionKey]bool)
+	}
+	return nil
+}
+
+// returns the start of the pgwatch2 weekly partition containing t, it's the same as date_trunc('week', t) in UTC
+func partitionWeekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+	return day.AddDate(0, 0, -offset)
+}
+
+// returns the name pgwatch2 gives to the partition of metric starting at weekStart, e.g. subpartitions.cpu_load_y2024w18
+func partitionName(metric string, weekStart time.Time) string {
+	year, week := weekStart.ISOWeek()
+	return fmt.Sprintf("subpartitions.%v_y%04dw%02d", metric, year, week)
+}
+
+// makes sure that the partition of metric for the rows of dbname at t exists: in the "metric-time" storage schema
+// the partition for the week of t, and the following one.
+// A single DB call is in flight for each partition, the callers of the same partition wait for it.
+func (pm *partitionManager) ensure(ctx context.Context, metric string, dbname string, t time.Time) error {
+	if err := pm.ensureSchema(ctx); err != nil {
+		return fmt.Errorf("unknown storage schema: %w", err)
+	}
+
+	pm.mu.Lock()
+	schema := pm.schema
+
+	var key partitionKey
+	switch schema {
+	case StorageSchemaCustom:
+		pm.mu.Unlock()
+		return nil
+	case StorageSchemaMetricTime:
+		key = partitionKey{week: partitionWeekStart(t)}
+	case StorageSchemaMetricDbnameTime:
+		key = partitionKey{dbname: dbname, week: partitionWeekStart(t)}
+	}
+
+	if pm.ensured[metric] == nil {
+		pm.ensured[metric] = make(map[partitionKey]bool)
+	}
+	ensured := pm.ensured[metric][key]
+	pm.mu.Unlock()
+
+	if ensured {
+		return nil
+	}
+
+	return pm.flights.do(ctx, fmt.Sprintf("%v/%v/%v", metric, key.dbname, key.week.Unix()), func() error {
+		// ensured by a call that ended in the meantime
+		if pm.isEnsured(metric, key) {
+			return nil
+		}
+
+		var keys []partitionKey
+		var err error
+		switch schema {
+		case StorageSchemaMetricTime:
+			keys, err = pm.ensureWeekly(ctx, metric, t)
+		case StorageSchemaMetricDbnameTime:
+			keys, err = pm.ensureDbnameWeekly(ctx, metric, dbname, t)
+		case StorageSchemaTimescale:
+			err = pm.ensureTable(ctx, metric, ensureTimescaleQuery)
+		default:
+			err = pm.ensureTable(ctx, metric, ensureMetricTableQuery)
+		}
+		if err != nil {
+			pm.failedCount.Add(1)
+			return err
+		}
+
+		// in case the returned range doesn't cover the week of t (it always should), don't call it again for each sample
+		pm.markEnsured(schema, metric, append(keys, key)...)
+		return nil
+	})
+}
+
+func (pm *partitionManager) isEnsured(metric string, key partitionKey) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.ensured[metric][key]
+}
+
+// the keys ensured with a storage schema that has been changed in the meantime are not valid anymore, see setSchema
+func (pm *partitionManager) markEnsured(schema string, metric string, keys ...partitionKey) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.schema != schema {
+		return
+	}
+	if pm.ensured[metric] == nil {
+		pm.ensured[metric] = make(map[partitionKey]bool)
+	}
+	for _, key := range keys {
+		pm.ensured[metric][key] = true
+	}
+}
+
+// returns the partitions available, as reported by ensure_partition_metric_time
+func (pm *partitionManager) ensureWeekly(ctx context.Context, metric string, t time.Time) ([]partitionKey, error) {
+	week := partitionWeekStart(t)
+
+	// the week of t and the following one, as the 3rd param of ensure_partition_metric_time pre-creates 1 partition
+	candidates := []time.Time{week, week.Add(partitionWeek)}
+	missing := make(map[time.Time]bool, len(candidates))
+
+	var from, to time.Time
+	// other dynos may be creating the same partitions, see withAdvisoryLock
+	err := withAdvisoryLock(ctx, pm.store, "partitions:"+metric, func(tx *sql.Tx) error {
+		for _, w := range candidates {
+			var exists bool
+			if err := tx.QueryRowContext(ctx, partitionExistsQuery, partitionName(metric, w)).Scan(&exists); err != nil {
+				return err
+			}
+			missing[w] = !exists
+		}
+
+		return tx.QueryRowContext(ctx, ensurePartitionQuery, metric, t).Scan(&from, &to)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []partitionKey
+	for w := partitionWeekStart(from); w.Before(to); w = w.Add(partitionWeek) {
+		keys = append(keys, partitionKey{week: w})
+	}
+
+	for _, w := range candidates {
+		if missing[w] {
+			pm.report(partitionRange{Name: partitionName(metric, w), From: w, To: w.Add(partitionWeek)})
+		}
+	}
+
+	if isEnv(DebugEnv) {
+		fmt.Printf("[partitions.go:ensure] %v partitions available from %v to %v\n", metric, from, to)
+	}
+	return keys, nil
+}
+
+// the partitions are not reported, as pgwatch2 shortens the dbname in their names
+func (pm *partitionManager) ensureDbnameWeekly(ctx context.Context, metric string, dbname string, t time.Time) ([]partitionKey, error) {
+	var from, to time.Time
+	err := withAdvisoryLock(ctx, pm.store, "partitions:"+metric, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, ensureDbnamePartitionQuery, metric, dbname, t).Scan(&from, &to)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []partitionKey
+	for w := partitionWeekStart(from); w.Before(to); w = w.Add(partitionWeek) {
+		keys = append(keys, partitionKey{dbname: dbname, week: w})
+	}
+
+	if isEnv(DebugEnv) {
+		fmt.Printf("[partitions.go:ensure] %v partitions of %v available from %v to %v\n", metric, dbname, from, to)
+	}
+	return keys, nil
+}
+
+func (pm *partitionManager) ensureTable(ctx context.Context, metric string, query string) error {
+	return withAdvisoryLock(ctx, pm.store, "partitions:"+metric, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query, metric)
+		return err
+	})
+}
+
+func (pm *partitionManager) report(p partitionRange) {
+	fmt.Printf("created partition %v FOR VALUES FROM ('%v') TO ('%v')\n", p.Name, p.From.Format(time.RFC3339), p.To.Format(time.RFC3339))
+
+	pm.createdCount.Add(1)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.created = append(pm.created, p)
+	if len(pm.created) > partitionsReported {
+		pm.created = pm.created[len(pm.created)-partitionsReported:]
+	}
+}
+
+func (pm *partitionManager) metrics() []string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	metrics := make([]string, 0, len(pm.ensured))
+	for metric := range pm.ensured {
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// returns the dbnames whose partitions of metric have been ensured, only in the "metric-dbname-time" storage schema
+func (pm *partitionManager) dbnames(metric string) []string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.schema != StorageSchemaMetricDbnameTime {
+		return []string{""}
+	}
+
+	set := make(map[string]bool)
+	for key := range pm.ensured[metric] {
+		set[key.dbname] = true
+	}
+	dbnames := make([]string, 0, len(set))
+	for dbname := range set {
+		dbnames = append(dbnames, dbname)
+	}
+	return dbnames
+}
+
+// forgets the partitions ensured for metric, e.g. because some of them have been dropped.
+// In the "metric-dbname-time" storage schema the dbnames are kept, so that their partitions are still pre-created.
+func (pm *partitionManager) forget(metric string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	keys := make(map[partitionKey]bool)
+	for key := range pm.ensured[metric] {
+		if key.dbname != "" {
+			keys[partitionKey{dbname: key.dbname}] = false
+		}
+	}
+	pm.ensured[metric] = keys
+}
+
+// pre-creates the partitions of the current and next week for all the known metrics (and dbnames)
+func (pm *partitionManager) precreate() {
+	now := time.Now()
+	for _, metric := range pm.metrics() {
+		for _, dbname := range pm.dbnames(metric) {
+			for _, t := range []time.Time{now, now.Add(partitionWeek)} {
+				if err := pm.ensure(context.Background(), metric, dbname, t); err != nil {
+					fmt.Printf("DB error: unable to pre-create %v partitions for %v: %v\n", metric, t, err)
+				}
+			}
+		}
+	}
+}
+
+func (pm *partitionManager) start(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultPartitionsPrecreateInterval
+	}
+
+	pm.wg.Add(1)
+	go func() {
+		defer pm.wg.Done()
+
+		pm.precreate()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pm.precreate()
+			case <-pm.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (pm *partitionManager) close() {
+	close(pm.stopCh)
+	pm.wg.Wait()
+}
+
+func (pm *partitionManager) stats() interface{} {
+	pm.mu.Lock()
+	created := make([]partitionRange, len(pm.created))
+	copy(created, pm.created)
+	pm.mu.Unlock()
+
+	pm.mu.Lock()
+	schema, detected := pm.schema, pm.detected
+	pm.mu.Unlock()
+
+	return map[string]interface{}{
+		"schema":       schema,
+		"detected":     detected,
+		"created":      pm.createdCount.Load(),
+		"failed":       pm.failedCount.Load(),
+		"last_created": created,
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPartitionWeekStart(t *testing.T) {
+	tests := []struct {
+		t        string
+		expected string
+	}{
+		{"2024-04-30T10:15:00Z", "2024-04-29T00:00:00Z"},      // Tuesday
+		{"2024-04-29T00:00:00Z", "2024-04-29T00:00:00Z"},      // Monday midnight
+		{"2024-05-05T23:59:59Z", "2024-04-29T00:00:00Z"},      // Sunday
+		{"2024-04-29T01:00:00+02:00", "2024-04-22T00:00:00Z"}, // still Sunday in UTC
+	}
+
+	for _, test := range tests {
+		ts, _ := time.Parse(time.RFC3339, test.t)
+		if week := partitionWeekStart(ts).Format(time.RFC3339); week != test.expected {
+			t.Errorf("partitionWeekStart(%v) = %v, expected %v", test.t, week, test.expected)
+		}
+	}
+}
+
+func TestPartitionName(t *testing.T) {
+	week, _ := time.Parse(time.RFC3339, "2024-04-29T00:00:00Z")
+	if name := partitionName("cpu_load", week); name != "subpartitions.cpu_load_y2024w18" {
+		t.Errorf("unexpected partition name %v", name)
+	}
+
+	// the ISO year of the last days of December may be the next one
+	week, _ = time.Parse(time.RFC3339, "2024-12-30T00:00:00Z")
+	if name := partitionName("heroku_pg_stats", week); name != "subpartitions.heroku_pg_stats_y2025w01" {
+		t.Errorf("unexpected partition name %v", name)
+	}
+}
+
+func TestAdvisoryLockKey(t *testing.T) {
+	if advisoryLockKey("partitions:cpu_load") != advisoryLockKey("partitions:cpu_load") {
+		t.Errorf("the key of a name must be stable")
+	}
+	if advisoryLockKey("partitions:cpu_load") == advisoryLockKey("partitions:heroku_pg_stats") {
+		t.Errorf("different names must have different keys")
+	}
+}
+
+func TestPartitionManagerSchema(t *testing.T) {
+	pm := newPartitionManager(nil, "heroku_pg_stats")
+	if err := pm.setSchema("metric-dbname"); err == nil {
+		t.Errorf("expected an error for an unsupported storage schema")
+	}
+
+	if err := pm.setSchema(StorageSchemaMetricDbnameTime); err != nil {
+		t.Fatal(err)
+	}
+	week, _ := time.Parse(time.RFC3339, "2024-04-29T00:00:00Z")
+	pm.ensured["heroku_pg_stats"][partitionKey{dbname: "db1", week: week}] = true
+	pm.ensured["heroku_pg_stats"][partitionKey{dbname: "db2", week: week}] = true
+
+	// the dbnames are kept to pre-create their partitions
+	pm.forget("heroku_pg_stats")
+	if dbnames := pm.dbnames("heroku_pg_stats"); len(dbnames) != 2 {
+		t.Errorf("unexpected dbnames %v", dbnames)
+	}
+
+	// already ensured, no DB call
+	pm.ensured["heroku_pg_stats"][partitionKey{dbname: "db1", week: week}] = true
+	if err := pm.ensure(context.Background(), "heroku_pg_stats", "db1", week.Add(time.Hour)); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// nothing to ensure for custom tables
+	if err := pm.setSchema(StorageSchemaCustom); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.ensure(context.Background(), "heroku_pg_stats", "db1", week); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPartitionManagerSchemaUnknown(t *testing.T) {
+	t.Setenv("HKPG_LOGDRAIN_TEST_DB_URL", "postgres://localhost:1/metrics")
+	pm := newPartitionManager(newStore("HKPG_LOGDRAIN_TEST_DB_URL", 0), "heroku_pg_stats")
+
+	// the metrics DB is not reachable at startup, the default storage schema is not used
+	pm.detectSchema(context.Background(), "")
+	if pm.detected {
+		t.Fatalf("expected the storage schema to be unknown")
+	}
+	if err := pm.ensure(context.Background(), "heroku_pg_stats", "db1", time.Now()); err == nil || classifyError(err) != errorReconnect {
+		t.Errorf("expected a transient error while the storage schema is unknown, got %v", err)
+	}
+
+	// read by the first ensure once it's available
+	pm.override = StorageSchemaCustom
+	if err := pm.ensure(context.Background(), "heroku_pg_stats", "db1", time.Now()); err != nil || pm.schema != StorageSchemaCustom {
+		t.Errorf("expected the storage schema to be read by ensure, got %v %v", pm.schema, err)
+	}
+}
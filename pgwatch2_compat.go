@@ -0,0 +1,202 @@
+// reference(s):
+// 	https://github.com/cybertec-postgresql/pgwatch2/tree/master/pgwatch2/metrics
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// when set, the samples are also written as pgwatch2 built-in metrics, so that the panels of the stock dashboards
+// (e.g. "DB overview") reading db_size, backends, psutil_mem and db_stats work for Heroku databases.
+// The db_stats block counters are derived from the hit rates, see DbStatsData
+const Pgwatch2CompatEnv string = "HKPG_LOGDRAIN_PGWATCH2_COMPAT"
+
+// the pgwatch2 built-in metrics written in compatibility mode (cpu_load is always written)
+var pgwatch2CompatMetrics = []string{"db_size", "backends", "psutil_mem", "db_stats"}
+
+// same shape as the pgwatch2 db_size metric
+type DbSizeData struct {
+	Size_b int64 `json:"size_b"`
+}
+
+// same shape as the pgwatch2 backends metric, Heroku only reports the established connections (active-connections)
+// and the ones waiting on a lock (waiting-connections)
+type BackendsData struct {
+	Total   int64  `json:"total"`
+	Waiting *int64 `json:"waiting,omitempty"`
+}
+
+// same shape as the pgwatch2 psutil_mem metric, in bytes
+type PsutilMemData struct {
+	Total      int64   `json:"total"`
+	Used       int64   `json:"used"`
+	Free       int64   `json:"free"`
+	Buff_cache int64   `json:"buff_cache"`
+	Available  int64   `json:"available"`
+	Percent    float64 `json:"percent"`
+}
+
+// a subset of the pgwatch2 db_stats metric.
+// The stock dashboards compute the cache hit ratio from the deltas of the blks_hit/blks_read counters, which Heroku
+// doesn't report. They are synthetic counters instead, see blockCounters: their deltas give the hit rate reported by
+// Heroku, not the number of blocks read. The hit rates are also added as extra fields, for custom panels.
+type DbStatsData struct {
+	Numbackends          *int64   `json:"numbackends,omitempty"`
+	Blks_hit             *int64   `json:"blks_hit,omitempty"`
+	Blks_read            *int64   `json:"blks_read,omitempty"`
+	Index_cache_hit_rate *float64 `json:"index_cache_hit_rate,omitempty"`
+	Table_cache_hit_rate *float64 `json:"table_cache_hit_rate,omitempty"`
+}
+
+// the blocks accessed per second by the synthetic counters, only their ratio is meaningful
+const syntheticBlocksPerSecond float64 = 1000
+
+// the synthetic blks_hit/blks_read counters of a monitored db
+type blockCounter struct {
+	t    time.Time
+	hit  int64
+	read int64
+}
+
+// blockCounters derives the blks_hit/blks_read counters of each monitored db from its cache hit rates: between two
+// samples they grow by syntheticBlocksPerSecond blocks per second, split by the hit rate of the later sample.
+// They start from 0 and restart from 0 after a restart of the dyno, as the counters of pg_stat_database do after a
+// stats reset.
+type blockCounters struct {
+	mu     sync.Mutex
+	states map[string]*blockCounter // monitored db name -> counters
+}
+
+var compatBlocks = newBlockCounters()
+
+func newBlockCounters() *blockCounters {
+	return &blockCounters{states: make(map[string]*blockCounter)}
+}
+
+// returns the cache hit rate of a sample, the mean of the index and table hit rates as pg_stat_database counts both
+func cacheHitRate(rl *herokuPostgresLog) (float64, bool) {
+	index, okIndex := rl.floatValue("indexcachehitrate")
+	table, okTable := rl.floatValue("tablecachehitrate")
+	switch {
+	case okIndex && okTable:
+		return (index + table) / 2, true
+	case okIndex:
+		return index, true
+	case okTable:
+		return table, true
+	}
+	return 0, false
+}
+
+// adds a sample of dbname with the given hit rate and returns the counters.
+// A sample not newer than the previous one (e.g. delivered out of order) is ignored.
+func (bc *blockCounters) add(dbname string, rate float64, t time.Time) (hit int64, read int64, ok bool) {
+	rate = math.Max(0, math.Min(1, rate))
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	state, found := bc.states[dbname]
+	if !found {
+		bc.states[dbname] = &blockCounter{t: t}
+		return 0, 0, true
+	}
+	if !t.After(state.t) {
+		return 0, 0, false
+	}
+
+	blocks := math.Round(t.Sub(state.t).Seconds() * syntheticBlocksPerSecond)
+	hits := math.Round(blocks * rate)
+	state.t = t
+	state.hit += int64(hits)
+	state.read += int64(blocks - hits)
+	return state.hit, state.read, true
+}
+
+// returns the pgwatch2 built-in metrics corresponding to the samples of a log line, metric name -> data.
+// A metric is omitted when the samples it requires have not been received.
+func pgwatch2CompatData(rl *herokuPostgresLog) map[string]interface{} {
+	const kB int64 = 1024
+
+	data := make(map[string]interface{})
+
+	if dbsize, ok := rl.intValue("dbsize"); ok {
+		data["db_size"] = DbSizeData{Size_b: dbsize}
+	}
+
+	if active, ok := rl.intValue("activeconnections"); ok {
+		data["backends"] = BackendsData{Total: active, Waiting: optInt(rl.intValue("waitingconnections"))}
+	}
+
+	total, okTotal := rl.intValue("memorytotal")
+	free, okFree := rl.intValue("memoryfree")
+	cached, okCached := rl.intValue("memorycached")
+	if okTotal && okFree && okCached {
+		mem := PsutilMemData{
+			Total:      total * kB,
+			Free:       free * kB,
+			Buff_cache: cached * kB,
+		}
+		mem.Used = mem.Total - mem.Free - mem.Buff_cache
+		mem.Available = mem.Free + mem.Buff_cache
+		if mem.Total > 0 {
+			mem.Percent = float64(mem.Used) / float64(mem.Total) * 100
+		}
+		data["psutil_mem"] = mem
+	}
+
+	dbStats := DbStatsData{
+		Numbackends:          optInt(rl.intValue("activeconnections")),
+		Index_cache_hit_rate: optFloat(rl.floatValue("indexcachehitrate")),
+		Table_cache_hit_rate: optFloat(rl.floatValue("tablecachehitrate")),
+	}
+	if dbStats.Numbackends != nil || dbStats.Index_cache_hit_rate != nil || dbStats.Table_cache_hit_rate != nil {
+		data["db_stats"] = dbStats
+	}
+
+	return data
+}
+
+// adds the synthetic blks_hit/blks_read counters of dbname to the db_stats of data
+func (bc *blockCounters) addTo(data map[string]interface{}, rl *herokuPostgresLog, dbname string, t time.Time) {
+	rate, ok := cacheHitRate(rl)
+	if !ok {
+		return
+	}
+	hit, read, ok := bc.add(dbname, rate, t)
+	if !ok {
+		return
+	}
+
+	dbStats, _ := data["db_stats"].(DbStatsData)
+	dbStats.Blks_hit = &hit
+	dbStats.Blks_read = &read
+	data["db_stats"] = dbStats
+}
+
+// writes the samples of a log line as pgwatch2 built-in metrics
+func insertPgwatch2CompatMetrics(rl *herokuPostgresLog, t time.Time, monitoreddbname string) error {
+	data := pgwatch2CompatData(rl)
+	compatBlocks.addTo(data, rl, monitoreddbname, t)
+	tags := rl.tagData(sourceTags)
+
+	for _, metric := range pgwatch2CompatMetrics {
+		if _, ok := data[metric]; !ok {
+			continue
+		}
+
+		jsonData, err := json.Marshal(data[metric])
+		if err != nil {
+			fmt.Printf("could not marshal json: %s\n", err)
+			return err
+		}
+
+		_ = metricInsert(metric, t, monitoreddbname, jsonData, tags)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPgwatch2CompatData(t *testing.T) {
+	rl := parseTestLogLine(t, testHerokuPostgresLogLine)
+
+	data := pgwatch2CompatData(rl)
+	for _, metric := range pgwatch2CompatMetrics {
+		if _, ok := data[metric]; !ok {
+			t.Errorf("missing metric %v", metric)
+		}
+	}
+
+	jsonData, _ := json.Marshal(data["db_size"])
+	if string(jsonData) != `{"size_b":90755887}` {
+		t.Errorf("unexpected db_size %s", jsonData)
+	}
+
+	jsonData, _ = json.Marshal(data["backends"])
+	if string(jsonData) != `{"total":15,"waiting":0}` {
+		t.Errorf("unexpected backends %s", jsonData)
+	}
+
+	mem := data["psutil_mem"].(PsutilMemData)
+	if mem.Total != 3944484*1024 || mem.Used != (3944484-74980-2984436)*1024 || mem.Available != (74980+2984436)*1024 {
+		t.Errorf("unexpected psutil_mem %+v", mem)
+	}
+
+	// a metric is omitted if its samples are missing
+	rl = parseTestLogLine(t, "source=DATABASE sample#db_size=90755887bytes sample#memory-total=3944484kB")
+	data = pgwatch2CompatData(rl)
+	if len(data) != 1 || data["db_size"] == nil {
+		t.Errorf("unexpected metrics %v", data)
+	}
+}
+
+func TestBlockCounters(t *testing.T) {
+	bc := newBlockCounters()
+	t0 := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	dbStats := func(line string, at time.Time) DbStatsData {
+		rl := parseTestLogLine(t, line)
+		data := pgwatch2CompatData(rl)
+		bc.addTo(data, rl, "mydb", at)
+		s, _ := data["db_stats"].(DbStatsData)
+		return s
+	}
+
+	first := dbStats("source=DATABASE sample#index-cache-hit-rate=0.99 sample#table-cache-hit-rate=0.97", t0)
+	if first.Blks_hit == nil || *first.Blks_hit != 0 || *first.Blks_read != 0 {
+		t.Fatalf("expected the counters to start from 0, got %+v", first)
+	}
+
+	// the deltas give the hit rate of the sample, as computed by the stock dashboards
+	second := dbStats("source=DATABASE sample#index-cache-hit-rate=0.99 sample#table-cache-hit-rate=0.97", t0.Add(time.Minute))
+	third := dbStats("source=DATABASE sample#table-cache-hit-rate=0.5", t0.Add(2*time.Minute))
+	for _, c := range []struct {
+		prev, cur DbStatsData
+		rate      float64
+	}{{first, second, 0.98}, {second, third, 0.5}} {
+		hit := *c.cur.Blks_hit - *c.prev.Blks_hit
+		read := *c.cur.Blks_read - *c.prev.Blks_read
+		if ratio := float64(hit) / float64(hit+read); math.Abs(ratio-c.rate) > 1e-4 {
+			t.Errorf("expected a hit ratio of %v, got %v", c.rate, ratio)
+		}
+	}
+
+	// a sample delivered out of order is not counted
+	late := dbStats("source=DATABASE sample#table-cache-hit-rate=0.1", t0.Add(90*time.Second))
+	if late.Blks_hit != nil || late.Table_cache_hit_rate == nil {
+		t.Errorf("expected no counters for an out of order sample, got %+v", late)
+	}
+
+	// no counters without a hit rate
+	if s := dbStats("source=DATABASE sample#active-connections=15", t0.Add(3*time.Minute)); s.Blks_hit != nil {
+		t.Errorf("expected no counters without a hit rate, got %+v", s)
+	}
+}
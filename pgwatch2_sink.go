@@ -0,0 +1,150 @@
+// reference(s):
+// 	https://pkg.go.dev/github.com/lib/pq#hdr-Bulk_imports
+// 	https://github.com/cybertec-postgresql/pgwatch2/tree/master/pgwatch2/sql/metric_store
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+const Pgwatch2SinkName string = "pgwatch2"
+
+// pgwatch2Sink copies the rows into the pgwatch2 metric tables of the metrics DB, one COPY per metric table
+type pgwatch2Sink struct {
+	store *store
+
+	// if set, the partitions for the rows time are ensured before they are written
+	partitions *partitionManager
+	// if set, the dbnames of the rows are registered once they are written
+	dbnames *dbnameRegistry
+}
+
+// the metrics DB and its jobs are set up by db.go
+func newPgwatch2SinkFromEnv() (Sink, error) {
+	if metricsStore == nil {
+		return nil, fmt.Errorf("metrics DB not configured")
+	}
+	return &pgwatch2Sink{store: metricsStore, partitions: partitions, dbnames: dbnames}, nil
+}
+
+// rows of the same metric keep their order, transient errors are retried by the store
+func (ps *pgwatch2Sink) WriteBatch(ctx context.Context, rows []metricRow) error {
+	metrics, byMetric := groupRowsByMetric(rows)
+	for _, metric := range metrics {
+		if err := ps.copyRows(ctx, metric, byMetric[metric]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *pgwatch2Sink) copyRows(ctx context.Context, metric string, rows []metricRow) error {
+	if ps.partitions != nil {
+		// this guarantees there are always the metrics table and the partitions for the rows time (and dbname) ready,
+		// the partition manager only calls the DB for a week it has not ensured yet (e.g. a dyno running across the week boundary)
+		seen := make(map[partitionKey]bool)
+		for _, row := range rows {
+			key := partitionKey{dbname: row.dbname, week: partitionWeekStart(row.time)}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			// the COPY would fail without the partition, the rows are spooled instead and the partition is ensured again
+			// when they are replayed
+			if err := ps.partitions.ensure(ctx, metric, row.dbname, row.time); err != nil {
+				return &retryableSinkError{fmt.Errorf("unable to ensure %v partition for %v: %w", metric, row.time, err)}
+			}
+		}
+	}
+
+	err := ps.store.withRetry(ctx, "copy into "+metric, func(db *sql.DB) error {
+		return copyRowsTx(ctx, db, "", metric, metricRowColumns, len(rows), func(i int) ([]interface{}, error) {
+			return metricRowValues(rows[i]), nil
+		})
+	})
+	if err == nil && ps.dbnames != nil {
+		ps.dbnames.register(ctx, metric, rows)
+	}
+	return err
+}
+
+// rows are written by WriteBatch
+func (ps *pgwatch2Sink) Flush(_ context.Context) error {
+	return nil
+}
+
+// the metrics DB is closed by db.go, as it's shared with the partitions and retention jobs
+func (ps *pgwatch2Sink) Close(_ context.Context) error {
+	return nil
+}
+
+func (ps *pgwatch2Sink) ping(ctx context.Context) error {
+	return ps.store.ping(ctx)
+}
+
+// the columns of the pgwatch2 metric tables
+var metricRowColumns = []string{"time", "dbname", "data", "tag_data"}
+
+// the values of metricRowColumns, data is passed as string as pq would encode a []byte as bytea and the column is jsonb
+func metricRowValues(row metricRow) []interface{} {
+	return []interface{}{row.time, row.dbname, string(row.data), metricRowTags(row)}
+}
+
+// tag_data is NULL without tags
+func metricRowTags(row metricRow) interface{} {
+	if row.tags == nil {
+		return nil
+	}
+	return string(row.tags)
+}
+
+// copies n rows into the columns of table, the table is looked up in the search_path if schema is empty.
+// COPY is only allowed inside a transaction, see https://pkg.go.dev/github.com/lib/pq#hdr-Bulk_imports
+func copyRowsTx(ctx context.Context, db *sql.DB, schema string, table string, columns []string, n int, values func(i int) ([]interface{}, error)) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := pq.CopyIn(table, columns...)
+	if schema != "" {
+		query = pq.CopyInSchema(schema, table, columns...)
+	}
+	stmt, err := txn.PrepareContext(ctx, query)
+	if err != nil {
+		_ = txn.Rollback()
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		var args []interface{}
+		if args, err = values(i); err == nil {
+			_, err = stmt.ExecContext(ctx, args...)
+		}
+		if err != nil {
+			_ = stmt.Close()
+			_ = txn.Rollback()
+			return err
+		}
+	}
+
+	// an Exec without args flushes the buffered data
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		_ = stmt.Close()
+		_ = txn.Rollback()
+		return err
+	}
+
+	if err = stmt.Close(); err != nil {
+		_ = txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
@@ -0,0 +1,92 @@
+// reference(s):
+// 	https://github.com/cybertec-postgresql/pgwatch/tree/master/internal/sinks
+// 	https://github.com/cybertec-postgresql/pgwatch/blob/master/internal/sinks/sql/admin_functions.sql
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+const Pgwatch3SinkName string = "pgwatch3"
+
+// the pgwatch v3 measurements DB, it's written side by side with the pgwatch2 one when both sinks are enabled
+const Pgwatch3DbUrlEnv string = "PGWATCH3_URL"
+
+// the pgwatch v3 storage schema is read from admin.storage_schema_type at startup, unless it's set here
+const Pgwatch3StorageSchemaEnv string = "HKPG_LOGDRAIN_PGWATCH3_STORAGE_SCHEMA"
+
+// the pgwatch v3 storage schemas -> the pgwatch2 storage schema calling the same admin function for each metric.
+// The pgwatch2 names are accepted as well.
+var pgwatch3StorageSchemas = map[string]string{
+	"postgres":  StorageSchemaMetricDbnameTime, // admin.ensure_partition_metric_dbname_time
+	"timescale": StorageSchemaTimescale,        // admin.ensure_partition_timescale
+}
+
+// pgwatch3Sink writes the rows into the pgwatch v3 measurements DB, with the columns time, dbname, data and tag_data.
+// The metric tables are ensured by calling the admin function of the v3 storage schema, see pgwatch3StorageSchemas,
+// with "postgres" as the default. This relies on the v3 admin functions keeping the pgwatch2 signatures, which is
+// not checked against a v3 DB by the tests.
+// The partitions pre-creation, the retention and the dbnames registration are those of the pgwatch2 sink, with
+// their own connection to the v3 DB.
+type pgwatch3Sink struct {
+	pgwatch2Sink
+
+	retention *retentionJob
+}
+
+func newPgwatch3SinkFromEnv() (Sink, error) {
+	if !isEnv(Pgwatch3DbUrlEnv) {
+		return nil, fmt.Errorf("%v not set", Pgwatch3DbUrlEnv)
+	}
+
+	store := newStore(Pgwatch3DbUrlEnv, envInt(DbMaxRetriesEnv, defaultDbMaxRetries))
+
+	pm := newPartitionManager(store, logMappings.metrics()...)
+	pm.aliases = pgwatch3StorageSchemas
+	// the default, until it's read from the DB by open
+	pm.schema = pgwatch3StorageSchemas["postgres"]
+	registerStats("pgwatch3_partitions", pm.stats)
+
+	ps := &pgwatch3Sink{pgwatch2Sink: pgwatch2Sink{store: store, partitions: pm}}
+
+	// the same retention config of pgwatch2
+	if ps.retention = newRetentionJobFromEnv(store, pm); ps.retention != nil {
+		registerStats("pgwatch3_retention", ps.retention.stats)
+	}
+
+	if isEnv(RegisterDbnamesEnv) {
+		ps.dbnames = newDbnameRegistry(store, nil, "")
+		registerStats("pgwatch3_dbnames", ps.dbnames.stats)
+	}
+
+	return ps, nil
+}
+
+// validates the connectivity and starts the partition maintenance, a DB not reachable yet doesn't stop the drain
+func (ps *pgwatch3Sink) open(ctx context.Context) error {
+	if err := ps.store.waitReady(ctx); err != nil {
+		if classifyError(err) == errorFatal {
+			return err
+		}
+		fmt.Printf("pgwatch3 DB not ready, starting anyway: %v\n", err)
+	}
+
+	ps.partitions.detectSchema(ctx, os.Getenv(Pgwatch3StorageSchemaEnv))
+	ps.partitions.start(envDuration(PartitionsPrecreateIntervalEnv, defaultPartitionsPrecreateInterval))
+	if ps.retention != nil {
+		ps.retention.start(envDuration(RetentionIntervalEnv, defaultRetentionInterval))
+	}
+	return nil
+}
+
+func (ps *pgwatch3Sink) Close(_ context.Context) error {
+	ps.partitions.close()
+	if ps.retention != nil {
+		ps.retention.close()
+	}
+	ps.store.close()
+	return nil
+}
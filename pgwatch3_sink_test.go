@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestNewPgwatch3SinkFromEnv(t *testing.T) {
+	t.Setenv(Pgwatch3DbUrlEnv, "")
+	os.Unsetenv(Pgwatch3DbUrlEnv)
+	if _, err := newPgwatch3SinkFromEnv(); err == nil {
+		t.Errorf("expected an error without %v", Pgwatch3DbUrlEnv)
+	}
+
+	t.Setenv(Pgwatch3DbUrlEnv, "postgres://localhost/pgwatch_metrics")
+	sink, err := newPgwatch3SinkFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := sink.(*pgwatch3Sink)
+	if ps.partitions.schema != StorageSchemaMetricDbnameTime {
+		t.Errorf("unexpected default storage schema %v", ps.partitions.schema)
+	}
+	if _, ok := sink.(readinessChecker); !ok {
+		t.Errorf("expected the spool replay to check the pgwatch3 DB")
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPgwatch3StorageSchemas(t *testing.T) {
+	pm := newPartitionManager(nil, "heroku_pg_stats")
+	pm.aliases = pgwatch3StorageSchemas
+
+	for schema, expected := range map[string]string{
+		"postgres":                    StorageSchemaMetricDbnameTime,
+		"timescale":                   StorageSchemaTimescale,
+		StorageSchemaMetricDbnameTime: StorageSchemaMetricDbnameTime,
+	} {
+		pm.detectSchema(context.Background(), schema)
+		if pm.schema != expected {
+			t.Errorf("expected %v to be handled as %v, got %v", schema, expected, pm.schema)
+		}
+	}
+}
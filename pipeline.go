@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const QueueSizeEnv string = "HKPG_LOGDRAIN_QUEUE_SIZE"
+const WorkersEnv string = "HKPG_LOGDRAIN_WORKERS"
+const QueueFullPolicyEnv string = "HKPG_LOGDRAIN_QUEUE_FULL_POLICY"
+
+const defaultQueueSize int = 10000
+const defaultWorkers int = 4
+
+// what to do when a request brings more samples than the free room in the queue
+const (
+	QueueFullDropOldest string = "drop-oldest" // the oldest queued samples are discarded to make room
+	QueueFullDropNewest string = "drop-newest" // the incoming samples are discarded
+	QueueFullReject     string = "reject"      // the request is rejected with a 503 so that Logplex can retry it
+)
+
+// a parsed heroku-postgres log line waiting to be stored
+type logSample struct {
+	rl *herokuPostgresLog
+	t  time.Time
+}
+
+// ingestPipeline decouples the HTTP handler from the database writes: processLogs only parses the log lines
+// and enqueues the samples, a pool of workers takes them from the bounded queue and stores them.
+type ingestPipeline struct {
+	queue   chan *logSample
+	policy  string
+	workers int
+	handle  func(*logSample)
+
+	// protects queue from being closed while a request is enqueuing
+	mu     sync.RWMutex
+	closed bool
+
+	wg sync.WaitGroup
+
+	// the samples queued or about to be queued with the reject policy, a request reserves the room for all of its samples
+	// before queuing them so that concurrent requests can't overflow the queue (and get their samples dropped)
+	reserved atomic.Int64
+
+	enqueued  atomic.Int64
+	processed atomic.Int64
+	dropped   atomic.Int64
+	rejected  atomic.Int64
+}
+
+func newIngestPipeline(size int, workers int, policy string, handle func(*logSample)) *ingestPipeline {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	switch policy {
+	case QueueFullDropOldest, QueueFullDropNewest, QueueFullReject:
+	default:
+		if policy != "" {
+			fmt.Printf("unknown queue full policy[%v], using %v\n", policy, QueueFullDropOldest)
+		}
+		policy = QueueFullDropOldest
+	}
+
+	return &ingestPipeline{
+		queue:   make(chan *logSample, size),
+		policy:  policy,
+		workers: workers,
+		handle:  handle,
+	}
+}
+
+func (p *ingestPipeline) start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+func (p *ingestPipeline) work() {
+	defer p.wg.Done()
+
+	for s := range p.queue {
+		if p.policy == QueueFullReject {
+			p.reserved.Add(-1)
+		}
+		p.handle(s)
+		p.processed.Add(1)
+	}
+}
+
+// enqueues the samples of a request, it returns false if the request must be rejected
+func (p *ingestPipeline) enqueue(samples []*logSample) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		p.rejected.Add(int64(len(samples)))
+		return false
+	}
+
+	// the whole request is rejected, as Logplex would send again all of its lines
+	if p.policy == QueueFullReject && !p.reserve(len(samples)) {
+		p.rejected.Add(int64(len(samples)))
+		return false
+	}
+
+	for _, s := range samples {
+		p.push(s)
+	}
+
+	return true
+}
+
+// reserves the room for n samples in the queue, it returns false if there isn't enough
+func (p *ingestPipeline) reserve(n int) bool {
+	for {
+		reserved := p.reserved.Load()
+		if reserved+int64(n) > int64(cap(p.queue)) {
+			return false
+		}
+		if p.reserved.CompareAndSwap(reserved, reserved+int64(n)) {
+			return true
+		}
+	}
+}
+
+func (p *ingestPipeline) push(s *logSample) {
+	for {
+		select {
+		case p.queue <- s:
+			p.enqueued.Add(1)
+			return
+		default:
+		}
+
+		if p.policy != QueueFullDropOldest {
+			p.dropped.Add(1)
+			return
+		}
+
+		// make room discarding the oldest sample, the workers may have already made room in the meantime
+		select {
+		case <-p.queue:
+			p.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// stops accepting samples and waits for the workers to store the queued ones or for the ctx to be done
+func (p *ingestPipeline) close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%v samples not processed: %w", len(p.queue), ctx.Err())
+	}
+}
+
+func (p *ingestPipeline) stats() interface{} {
+	return map[string]interface{}{
+		"queue_depth":    len(p.queue),
+		"queue_capacity": cap(p.queue),
+		"queue_policy":   p.policy,
+		"workers":        p.workers,
+		"enqueued":       p.enqueued.Load(),
+		"processed":      p.processed.Load(),
+		"dropped":        p.dropped.Load(),
+		"rejected":       p.rejected.Load(),
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSamples(n int) []*logSample {
+	samples := make([]*logSample, n)
+	for i := range samples {
+		samples[i] = &logSample{rl: new(herokuPostgresLog), t: time.Unix(int64(i), 0)}
+	}
+	return samples
+}
+
+func TestIngestPipelineQueueFullPolicies(t *testing.T) {
+	// workers are not started so that the queue fills up
+	oldest := newIngestPipeline(2, 1, QueueFullDropOldest, func(*logSample) {})
+	if !oldest.enqueue(newTestSamples(3)) {
+		t.Fatalf("drop-oldest must not reject requests")
+	}
+	if s := <-oldest.queue; s.t.Unix() != 1 {
+		t.Errorf("drop-oldest kept sample %v, expected 1", s.t.Unix())
+	}
+	if oldest.dropped.Load() != 1 {
+		t.Errorf("drop-oldest dropped %v samples, expected 1", oldest.dropped.Load())
+	}
+
+	newest := newIngestPipeline(2, 1, QueueFullDropNewest, func(*logSample) {})
+	newest.enqueue(newTestSamples(3))
+	if s := <-newest.queue; s.t.Unix() != 0 {
+		t.Errorf("drop-newest kept sample %v, expected 0", s.t.Unix())
+	}
+
+	reject := newIngestPipeline(2, 1, QueueFullReject, func(*logSample) {})
+	if reject.enqueue(newTestSamples(3)) {
+		t.Errorf("reject must reject a request larger than the free room")
+	}
+	if len(reject.queue) != 0 {
+		t.Errorf("rejected request enqueued %v samples", len(reject.queue))
+	}
+}
+
+func TestIngestPipelineRejectConcurrent(t *testing.T) {
+	// workers are not started so that the queue fills up
+	p := newIngestPipeline(10, 1, QueueFullReject, func(*logSample) {})
+
+	var wg sync.WaitGroup
+	var accepted atomic.Int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p.enqueue(newTestSamples(3)) {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the requests that don't fit are all rejected, none of their samples is dropped
+	if accepted.Load() != 3 || p.dropped.Load() != 0 || len(p.queue) != 9 || p.rejected.Load() != 17*3 {
+		t.Errorf("accepted %v dropped %v queued %v rejected %v", accepted.Load(), p.dropped.Load(), len(p.queue), p.rejected.Load())
+	}
+}
+
+func TestIngestPipelineCloseDrainsQueue(t *testing.T) {
+	handled := 0
+	p := newIngestPipeline(10, 1, QueueFullDropOldest, func(*logSample) { handled++ })
+	p.start()
+	p.enqueue(newTestSamples(5))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if handled != 5 {
+		t.Errorf("handled %v samples, expected 5", handled)
+	}
+	if p.enqueue(newTestSamples(1)) {
+		t.Errorf("a closed pipeline must reject samples")
+	}
+}
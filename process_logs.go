@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,32 +20,46 @@ import (
 const DebugEnv string = "HKPG_LOGDRAIN_DEBUG"
 const PostgresProcId string = "heroku-postgres"
 
-var SourcesMap = make(map[string]string)
-var SourcesOnceMap = make(map[string]*sync.Once)
+// number of values that could not be parsed, by sample key
+var parseFailuresMu sync.Mutex
+var parseFailures = make(map[string]int64)
+
+// number of values received for the l2met keys without a mapping, by key
+var extraKeysMu sync.Mutex
+var extraKeys = make(map[string]int64)
+
+// a number followed by an optional unit, e.g. 90755887bytes or 3944484kB
+var numberWithUnitRegexp = regexp.MustCompile(`^([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)([a-zA-Z%]*)$`)
 
 // This struct and the method below takes care of capturing the data we need
 // from each log line. We pass it to Keith Rarick's logfmt parser and it
 // handles parsing for us.
+// The samples to capture and how to parse them are defined by the mapping of the log line procid (see mapping.go),
+// only the fields in values have been received and parsed successfully.
 type herokuPostgresLog struct {
 	source string
 	addon  string
 
-	loadavg1m  float64
-	loadavg5m  float64
-	loadavg15m float64
-
-	readiops  float64
-	writeiops float64
+	// Logplex header fields of the log line and the drain token of its request
+	hostname   string
+	name       string
+	drainToken string
 
-	tmpdiskused      int64
-	tmpdiskavailable int64
+	mapping map[string]*sampleMapping // logfmt key -> sample mapping
+	values  map[string]interface{}    // field -> int64 or float64 value
 
-	memorytotal    int64
-	memoryfree     int64
-	memorycached   int64
-	memorypostgres int64
+	// l2met keys without a mapping, written to the extraMetric (if any)
+	extraMetric string
+	extras      map[string]interface{} // key -> float64 value, or the raw string if it's not a number
+	extraUnits  map[string]string      // key -> unit of its value, e.g. kB
+}
 
-	walpercentageused float64
+func newHerokuPostgresLog(mapping map[string]*sampleMapping) *herokuPostgresLog {
+	return &herokuPostgresLog{
+		mapping: mapping,
+		values:  make(map[string]interface{}),
+		extras:  make(map[string]interface{}),
+	}
 }
 
 func (r *herokuPostgresLog) HandleLogfmt(key, val []byte) error {
@@ -52,64 +67,175 @@ func (r *herokuPostgresLog) HandleLogfmt(key, val []byte) error {
 		r.source = string(val)
 	} else if string(key) == "addon" {
 		r.addon = string(val)
-	} else if string(key) == "sample#load-avg-1m" { // cpu_load
-		r.loadavg1m, _ = strconv.ParseFloat(string(val), 64)
-	} else if string(key) == "sample#load-avg-5m" { // cpu_load
-		r.loadavg5m, _ = strconv.ParseFloat(string(val), 64)
-	} else if string(key) == "sample#load-avg-15m" { // cpu_load
-		r.loadavg15m, _ = strconv.ParseFloat(string(val), 64)
-	} else if string(key) == "sample#read-iops" { // heroku_pg_stats
-		r.readiops, _ = strconv.ParseFloat(string(val), 64)
-	} else if string(key) == "sample#write-iops" { // heroku_pg_stats
-		r.writeiops, _ = strconv.ParseFloat(string(val), 64)
-	} else if string(key) == "sample#tmp-disk-used" { // heroku_pg_stats
-		r.tmpdiskused, _ = strconv.ParseInt(string(val), 10, 64)
-	} else if string(key) == "sample#tmp-disk-available" { // heroku_pg_stats
-		r.tmpdiskavailable, _ = strconv.ParseInt(string(val), 10, 64)
-	} else if string(key) == "sample#memory-total" { // kB // heroku_pg_stats
-		r.memorytotal, _ = strconv.ParseInt(strings.TrimSuffix(string(val), "kB"), 10, 64)
-	} else if string(key) == "sample#memory-free" { // kB // heroku_pg_stats
-		r.memoryfree, _ = strconv.ParseInt(strings.TrimSuffix(string(val), "kB"), 10, 64)
-	} else if string(key) == "sample#memory-cached" { // kB // heroku_pg_stats
-		r.memorycached, _ = strconv.ParseInt(strings.TrimSuffix(string(val), "kB"), 10, 64)
-	} else if string(key) == "sample#memory-postgres" { // kB // heroku_pg_stats
-		r.memorypostgres, _ = strconv.ParseInt(strings.TrimSuffix(string(val), "kB"), 10, 64)
-	} else if string(key) == "sample#wal-percentage-used" { // heroku_pg_stats
-		r.walpercentageused, _ = strconv.ParseFloat(string(val), 64)
+	} else if sm, ok := r.mapping[string(key)]; ok {
+		r.parse(sm, val)
+	} else if r.extraMetric != "" && isL2metKey(string(key)) {
+		r.parseExtra(string(key), string(val))
 	}
 	return nil
 }
 
-type CpuLoadData struct {
-	Load_1min  float64 `json:"load_1min"`
-	Load_5min  float64 `json:"load_5min"`
-	Load_15min float64 `json:"load_15min"`
+func isL2metKey(key string) bool {
+	for _, prefix := range l2metPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parses the value of a key without a mapping as a number where possible, its unit (if any) is kept aside
+func (r *herokuPostgresLog) parseExtra(key string, val string) {
+	extraKeysMu.Lock()
+	extraKeys[key]++
+	extraKeysMu.Unlock()
+
+	if m := numberWithUnitRegexp.FindStringSubmatch(val); m != nil {
+		if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+			r.extras[key] = v
+			if m[2] != "" {
+				if r.extraUnits == nil {
+					r.extraUnits = make(map[string]string)
+				}
+				r.extraUnits[key] = m[2]
+			}
+			return
+		}
+	}
+
+	r.extras[key] = val
+}
+
+// parses a sample according to its mapping, removing its unit suffix (if any), e.g. 90755887bytes
+func (r *herokuPostgresLog) parse(sm *sampleMapping, val []byte) {
+	var v interface{}
+	var err error
+
+	s := strings.TrimSuffix(string(val), sm.Unit)
+	if sm.Type == SampleTypeInt {
+		v, err = strconv.ParseInt(s, 10, 64)
+	} else {
+		v, err = strconv.ParseFloat(s, 64)
+	}
+
+	if err != nil {
+		// a malformed value is missing, instead of being stored as 0
+		delete(r.values, sm.Field)
+
+		parseFailuresMu.Lock()
+		parseFailures[sm.Key]++
+		parseFailuresMu.Unlock()
+
+		if isEnv(DebugEnv) {
+			fmt.Printf("invalid value[%v] for %v: %v\n", string(val), sm.Key, err)
+		}
+		return
+	}
+
+	r.values[sm.Field] = v
+}
+
+// returns whether the sample of field has been received with a valid value
+func (r *herokuPostgresLog) has(field string) bool {
+	_, ok := r.values[field]
+	return ok
+}
+
+func (r *herokuPostgresLog) intValue(field string) (int64, bool) {
+	switch v := r.values[field].(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func (r *herokuPostgresLog) floatValue(field string) (float64, bool) {
+	switch v := r.values[field].(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// returns the data of each metric the samples are mapped to, metric name -> field -> value.
+// Missing samples are omitted, instead of being stored as 0, and so are the metrics without any sample.
+func (r *herokuPostgresLog) metricData() map[string]map[string]interface{} {
+	data := make(map[string]map[string]interface{})
+	for _, sm := range r.mapping {
+		v, ok := r.values[sm.Field]
+		if !ok {
+			continue
+		}
+		for _, metric := range sm.Metrics {
+			if data[metric] == nil {
+				data[metric] = make(map[string]interface{})
+			}
+			data[metric][sm.Field] = v
+		}
+	}
+
+	if len(r.extras) > 0 {
+		extra := make(map[string]interface{}, len(r.extras)+1)
+		for key, v := range r.extras {
+			extra[key] = v
+		}
+		if len(r.extraUnits) > 0 {
+			// keys always contain a #, so they can't collide with units
+			extra["units"] = r.extraUnits
+		}
+		data[r.extraMetric] = extra
+	}
+	return data
 }
 
-type HerokuPgStatsData struct {
-	Load_1min  float64 `json:"load_1min"`
-	Load_5min  float64 `json:"load_5min"`
-	Load_15min float64 `json:"load_15min"`
+func parserStats() interface{} {
+	parseFailuresMu.Lock()
+	defer parseFailuresMu.Unlock()
 
-	Readiops  float64 `json:"readiops"`
-	Writeiops float64 `json:"writeiops"`
+	failures := make(map[string]int64, len(parseFailures))
+	for key, n := range parseFailures {
+		failures[key] = n
+	}
+	extraKeysMu.Lock()
+	defer extraKeysMu.Unlock()
+
+	extra := make(map[string]int64, len(extraKeys))
+	for key, n := range extraKeys {
+		extra[key] = n
+	}
 
-	Tmpdiskused      int64 `json:"tmpdiskused"`
-	Tmpdiskavailable int64 `json:"tmpdiskavailable"`
+	return map[string]interface{}{"parse_failures": failures, "extra_keys": extra}
+}
 
-	Memorytotal    int64 `json:"memorytotal"`
-	Memoryfree     int64 `json:"memoryfree"`
-	Memorycached   int64 `json:"memorycached"`
-	Memorypostgres int64 `json:"memorypostgres"`
+// returns a pointer to v if the sample has been received, nil otherwise so that it's omitted from the JSON
+func optInt(v int64, ok bool) *int64 {
+	if !ok {
+		return nil
+	}
+	return &v
+}
 
-	Walpercentageused float64 `json:"walpercentageused"`
+func optFloat(v float64, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	return &v
 }
 
 // HTTP request body (POST)
 // 672 <134>1 2024-04-28T00:03:49+00:00 host app heroku-postgres - source=DATABASE addon=postgresql-defined-24903 sample#current_transaction=122163235 sample#db_size=90755887bytes sample#tables=4 sample#active-connections=15 sample#waiting-connections=0 sample#index-cache-hit-rate=0.99997 sample#table-cache-hit-rate=0.99922 sample#load-avg-1m=0.285 sample#load-avg-5m=0.345 sample#load-avg-15m=0.39 sample#read-iops=0 sample#write-iops=2.597 sample#tmp-disk-used=543633408 sample#tmp-disk-available=72435159040 sample#memory-total=3944484kB sample#memory-free=74980kB sample#memory-cached=2984436kB sample#memory-postgres=33960kB sample#wal-percentage-used=0.06650439708481809
 // Apr 25 01:09:01 ab-cr-pg-logdrain2pgwatch2 app/web.1 [processLogs] heroku-postgres msg body[source=DATABASE addon=postgresql-defined-24903 sample#current_transaction=12298175 sample#db_size=92451631bytes sample#tables=4 sample#active-connections=15 sample#waiting-connections=0 sample#index-cache-hit-rate=0.99999 sample#table-cache-hit-rate=0.99933 sample#load-avg-1m=0.61 sample#load-avg-5m=0.67 sample#load-avg-15m=0.63 sample#read-iops=0 sample#write-iops=0.41772 sample#tmp-disk-used=543633408 sample#tmp-disk-available=72435159040 sample#memory-total=3944484kB sample#memory-free=841168kB sample#memory-cached=2629476kB sample#memory-postgres=20844kB sample#wal-percentage-used=0.06675254510753698
 
-// This is called every time we receive log lines from an app
+// the ingest pipeline that stores the samples parsed by processLogs, it's started by main()
+var ingest *ingestPipeline
+
+// This is called every time we receive log lines from an app.
+// Log lines are only parsed here, the samples are enqueued and stored by the ingest pipeline workers (see processSample)
+// so that a slow metrics DB doesn't stall the Logplex delivery.
 func processLogs(w http.ResponseWriter, r *http.Request) {
 
 	if isEnv(DebugEnv) {
@@ -117,6 +243,8 @@ func processLogs(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("[processLogs] HTTP request received %v\n", string(bodyBytes))
 	}
 
+	var samples []*logSample
+
 	lp := lpx.NewReader(bufio.NewReader(r.Body))
 	// a single request may contain multiple log lines. Loop over each of them
 	for lp.Next() {
@@ -125,19 +253,23 @@ func processLogs(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("[processLogs] PrivalVersion[%v] Time[%v] Hostname[%v] Name[%v] Procid[%v] Msgid[%v]\n", string(lp.Header().PrivalVersion), string(lp.Header().Time), string(lp.Header().Hostname), string(lp.Header().Name), string(lp.Header().Procid), string(lp.Header().Msgid))
 		}
 
-		// we only care about logs from the heroku-postgres
-		if string(lp.Header().Procid) == PostgresProcId {
+		// we only care about logs with a mapping, e.g. from the heroku-postgres
+		if mapping, ok := logMappings[string(lp.Header().Procid)]; ok {
 			if isEnv(DebugEnv) {
-				fmt.Printf("[processLogs] heroku-postgres msg body[%v]\n", strings.TrimSuffix(string(lp.Bytes()), "\n"))
+				fmt.Printf("[processLogs] %v msg body[%v]\n", string(lp.Header().Procid), strings.TrimSuffix(string(lp.Bytes()), "\n"))
 			}
 
-			rl := new(herokuPostgresLog)
+			rl := newHerokuPostgresLog(mapping)
+			rl.extraMetric = extraMetrics[string(lp.Header().Procid)]
+			rl.hostname = string(lp.Header().Hostname)
+			rl.name = string(lp.Header().Name)
+			rl.drainToken = r.Header.Get(DrainTokenHeader)
 			if err := logfmt.Unmarshal(lp.Bytes(), rl); err != nil {
 				fmt.Printf("Error parsing log line: %v\n", err)
 			} else {
 				if isEnv(DebugEnv) {
-					fmt.Printf("time[%v] source[%v] addon[%v] loadavg1m[%v] loadavg5m[%v] loadavg15m[%v] readiops[%v] writeiops[%v] tmpdiskused[%v] tmpdiskavailable[%v] memorytotal[%v] memoryfree[%v] memorycached[%v] memorypostgres[%v] walpercentageused[%v] \n", /*timeBucket*/
-						string(lp.Header().Time), rl.source, rl.addon, rl.loadavg1m, rl.loadavg5m, rl.loadavg15m, rl.readiops, rl.writeiops, rl.tmpdiskused, rl.tmpdiskavailable, rl.memorytotal, rl.memoryfree, rl.memorycached, rl.memorypostgres, rl.walpercentageused)
+					fmt.Printf("time[%v] source[%v] addon[%v] values%v\n", /*timeBucket*/
+						string(lp.Header().Time), rl.source, rl.addon, rl.values)
 				}
 
 				t, err := timestamp2Time(lp.Header().Time)
@@ -146,96 +278,77 @@ func processLogs(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 
-				// retrieve from the config {"DATABASE": "PGWATCH2_MONITOREDDB_MYTARGETDB_URL", "DATABASE_ONYX": "PGWATCH2_MONITOREDDB_2_URL", "DATABASE_GREEN": "PGWATCH2_MONITOREDDB_3_URL"}
-				// if source is one of the configured sources then retrieve the related monitored db name used to store metrics
-				//
-				if isEnv(DebugEnv) {
-					fmt.Printf("looking for source[%v] in [%v]\n", rl.source, SourcesMap)
-				}
-
-				if monitoreddbname, ok := SourcesMap[rl.source]; ok {
-					if isEnv(DebugEnv) {
-						fmt.Printf("found source[%v] monitored db name[%v]\n", rl.source, monitoreddbname)
-					}
-
-					// see sync.Once (https://medium.easyread.co/just-call-your-code-only-once-256f69ed39a8) as this is a multi-threaded app (http server spwans a thread to handle each request) with mutltiple DBs to manage
-					// it's executed only once for each dbname, before metrics are written, this guarantees there are always the metrics table and its partitions ready as dynos are cycled at max every 24h and each partition has a 7d time window.
-					SourcesOnceMap[rl.source].Do(func() {
-						fmt.Printf("create metrics table and partitions if not exists based on metrics timestamp for source %v\n", rl.source)
-						_ = initMetricsTableAndPartitions("heroku_pg_stats", t)
-						// TODO: to be removed
-						_ = initMetricsTableAndPartitions("cpu_load", t)
-					})
-
-					// TODO: to be removed
-					_ = insertCpuLoadMetrics(rl, t, monitoreddbname)
-
-					_ = insertHerokuPgStatsMetrics(rl, t, monitoreddbname)
-				}
+				samples = append(samples, &logSample{rl: rl, t: t})
 			}
 		}
 	}
+
+	if len(samples) > 0 && !ingest.enqueue(samples) {
+		http.Error(w, "ingest queue full", http.StatusServiceUnavailable)
+	}
 }
 
-func init() {
-	// {"DATABASE": "PGWATCH2_MONITOREDDB_MYTARGETDB_URL", "DATABASE_ONYX": "PGWATCH2_MONITOREDDB_2_URL", "DATABASE_GREEN": "PGWATCH2_MONITOREDDB_3_URL"}
+// This is called by the ingest pipeline workers for each sample parsed by processLogs
+func processSample(s *logSample) {
+	rl, t := s.rl, s.t
+
+	// retrieve from the config (see sources.go) the monitored db name used to store metrics of the drain token,
+	// addon and source of the log line, if any
+	//
+	if isEnv(DebugEnv) {
+		fmt.Printf("looking for drain token[%v] addon[%v] source[%v] in [%+v]\n", rl.drainToken, rl.addon, rl.source, sources.registry().rules)
+	}
+
+	monitoreddbname, ok := sources.lookup(rl.drainToken, rl.addon, rl.source)
+	if !ok {
+		// a database without a source rule is only stored in auto-discovery mode
+		monitoreddbname, ok = discovery.resolve(rl, t)
+	}
 
-	if err := json.Unmarshal([]byte(os.Getenv(SourcesEnv)), &SourcesMap); err == nil {
+	if ok {
 		if isEnv(DebugEnv) {
-			fmt.Printf("unmarshalled JSON size: %v data: %v\n", len(SourcesMap), os.Getenv(SourcesEnv))
+			fmt.Printf("found source[%v] monitored db name[%v]\n", rl.source, monitoreddbname)
 		}
 
-		for k := range SourcesMap {
-			SourcesOnceMap[k] = new(sync.Once)
+		_ = insertMetrics(rl, t, monitoreddbname)
+
+		if isEnv(Pgwatch2CompatEnv) {
+			_ = insertPgwatch2CompatMetrics(rl, t, monitoreddbname)
 		}
-	} else {
-		fmt.Printf("json.Unmarshal error: %v\n", err)
 	}
 }
 
-func insertHerokuPgStatsMetrics(rl *herokuPostgresLog, t time.Time, monitoreddbname string) error {
-	hpsd := new(HerokuPgStatsData)
-	hpsd.Load_1min = rl.loadavg1m
-	hpsd.Load_5min = rl.loadavg5m
-	hpsd.Load_15min = rl.loadavg15m
-
-	hpsd.Readiops = rl.readiops
-	hpsd.Writeiops = rl.writeiops
-
-	hpsd.Tmpdiskused = rl.tmpdiskused
-	hpsd.Tmpdiskavailable = rl.tmpdiskavailable
+func init() {
+	registerStats("parser", parserStats)
+	registerStats("discovery", discovery.stats)
+	registerStats("sources", sources.stats)
+}
 
-	hpsd.Memorytotal = rl.memorytotal
-	hpsd.Memoryfree = rl.memoryfree
-	hpsd.Memorycached = rl.memorycached
-	hpsd.Memorypostgres = rl.memorypostgres
+// writes the data of each metric the samples are mapped to (e.g. heroku_pg_stats)
+func insertMetrics(rl *herokuPostgresLog, t time.Time, monitoreddbname string) error {
+	metricData := rl.metricData()
 
-	hpsd.Walpercentageused = rl.walpercentageused
+	if data, ok := metricData[derivedMetric]; ok && isEnv(DerivedMetricsEnv) {
+		addDerivedFields(rl, data, connectionLimits)
+	}
 
-	jsonData, err := json.Marshal(hpsd)
-	if err != nil {
-		fmt.Printf("could not marshal json: %s\n", err)
-		return err
+	if data, ok := metricData[derivedMetric]; ok && isEnv(RatesEnv) {
+		for field, v := range counters.rates(monitoreddbname, rl, t) {
+			data[field] = v
+		}
 	}
 
-	herokuPgStatsInsert(t, monitoreddbname, jsonData)
-	return nil
-}
+	tags := rl.tagData(sourceTags)
 
-// TODO: to be removed
-func insertCpuLoadMetrics(rl *herokuPostgresLog, t time.Time, monitoreddbname string) error {
-	cld := new(CpuLoadData)
-	cld.Load_1min = rl.loadavg1m
-	cld.Load_5min = rl.loadavg5m
-	cld.Load_15min = rl.loadavg15m
+	for metric, data := range metricData {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			fmt.Printf("could not marshal json: %s\n", err)
+			return err
+		}
 
-	jsonData, err := json.Marshal(cld)
-	if err != nil {
-		fmt.Printf("could not marshal json: %s\n", err)
-		return err
+		_ = metricInsert(metric, t, monitoreddbname, jsonData, tags)
 	}
-
-	cpuLoadInsert(t, monitoreddbname, jsonData)
 	return nil
 }
 
@@ -256,3 +369,29 @@ func isEnv(key string) bool {
 	}
 	return false
 }
+
+// returns the integer value of the env var or def if it's not set or not valid
+func envInt(key string, def int) int {
+	if v, ok := os.LookupEnv(key); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			fmt.Printf("invalid %v value[%v], using default %v: %v\n", key, v, def, err)
+			return def
+		}
+		return i
+	}
+	return def
+}
+
+// returns the duration value (e.g. 5s, 1m) of the env var or def if it's not set or not valid
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			fmt.Printf("invalid %v value[%v], using default %v: %v\n", key, v, def, err)
+			return def
+		}
+		return d
+	}
+	return def
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kr/logfmt"
+)
+
+const testHerokuPostgresLogLine string = "source=DATABASE addon=postgresql-defined-24903 sample#current_transaction=122163235 sample#db_size=90755887bytes sample#tables=4 sample#active-connections=15 sample#waiting-connections=0 sample#index-cache-hit-rate=0.99997 sample#table-cache-hit-rate=0.99922 sample#load-avg-1m=0.285 sample#load-avg-5m=0.345 sample#load-avg-15m=0.39 sample#read-iops=0 sample#write-iops=2.597 sample#tmp-disk-used=543633408 sample#tmp-disk-available=72435159040 sample#memory-total=3944484kB sample#memory-free=74980kB sample#memory-cached=2984436kB sample#memory-postgres=33960kB sample#wal-percentage-used=0.06650439708481809"
+
+func parseTestLogLine(t *testing.T, line string) *herokuPostgresLog {
+	rl := newHerokuPostgresLog(logMappings[PostgresProcId])
+	if err := logfmt.Unmarshal([]byte(line), rl); err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+func TestHerokuPostgresLogHandleLogfmt(t *testing.T) {
+	rl := parseTestLogLine(t, testHerokuPostgresLogLine)
+
+	if rl.source != "DATABASE" || rl.addon != "postgresql-defined-24903" {
+		t.Errorf("unexpected source[%v] addon[%v]", rl.source, rl.addon)
+	}
+
+	expected := map[string]interface{}{
+		"currenttransaction": int64(122163235), "dbsize": int64(90755887), "tables": int64(4),
+		"activeconnections": int64(15), "waitingconnections": int64(0),
+		"indexcachehitrate": 0.99997, "tablecachehitrate": 0.99922,
+		"load_1min": 0.285, "memorytotal": int64(3944484), "tmpdiskavailable": int64(72435159040),
+	}
+	for field, v := range expected {
+		if rl.values[field] != v {
+			t.Errorf("unexpected %v[%v], expected %v", field, rl.values[field], v)
+		}
+	}
+	if len(rl.values) != len(logMappings[PostgresProcId]) {
+		t.Errorf("parsed %v samples, expected %v", len(rl.values), len(logMappings[PostgresProcId]))
+	}
+}
+
+func TestHerokuPostgresLogMissingSamples(t *testing.T) {
+	rl := parseTestLogLine(t, "source=DATABASE sample#db_size=90755887bytes sample#tables=four sample#load-avg-1m=0")
+
+	if !rl.has("dbsize") || !rl.has("load_1min") {
+		t.Errorf("expected dbsize and load_1min to be present")
+	}
+	if rl.has("tables") || rl.has("memorytotal") {
+		t.Errorf("expected tables (malformed) and memorytotal (missing) to be absent")
+	}
+	if parserStats().(map[string]interface{})["parse_failures"].(map[string]int64)["sample#tables"] == 0 {
+		t.Errorf("expected a parse failure for sample#tables")
+	}
+
+	data := rl.metricData()
+	jsonData, _ := json.Marshal(data["heroku_pg_stats"])
+	if string(jsonData) != `{"dbsize":90755887,"load_1min":0}` {
+		t.Errorf("unexpected heroku_pg_stats json %s", jsonData)
+	}
+	jsonData, _ = json.Marshal(data["cpu_load"])
+	if string(jsonData) != `{"load_1min":0}` {
+		t.Errorf("unexpected cpu_load json %s", jsonData)
+	}
+}
+
+func TestHerokuPostgresLogExtraKeys(t *testing.T) {
+	rl := newHerokuPostgresLog(logMappings[PostgresProcId])
+	rl.extraMetric = extraMetrics[PostgresProcId]
+	if err := logfmt.Unmarshal([]byte("source=DATABASE sample#db_size=90755887bytes sample#max-connections=500 measure#replication-lag=1.5s count#restarts=2 sample#mode=primary other=1"), rl); err != nil {
+		t.Fatal(err)
+	}
+
+	extra := rl.metricData()["heroku_pg_extra"]
+	jsonData, _ := json.Marshal(extra)
+	if string(jsonData) != `{"count#restarts":2,"measure#replication-lag":1.5,"sample#max-connections":500,"sample#mode":"primary","units":{"measure#replication-lag":"s"}}` {
+		t.Errorf("unexpected heroku_pg_extra json %s", jsonData)
+	}
+	if rl.has("dbsize") != true {
+		t.Errorf("expected the mapped samples to be parsed")
+	}
+}
+
+// a log line with missing and malformed samples, through the parse and write path up to the sinks
+func TestProcessLogsMissingSamples(t *testing.T) {
+	t.Setenv(SourcesEnv, `{"DATABASE": "PGWATCH2_MONITOREDDB_MYTARGETDB_URL"}`)
+
+	holder, pipeline, sink, sinkErr := sources, ingest, metricsSink, metricsSinkErr
+	defer func() { sources, ingest, metricsSink, metricsSinkErr = holder, pipeline, sink, sinkErr }()
+
+	backend := &testSink{}
+	sources = newSourcesHolder("")
+	metricsSink, metricsSinkErr = newFanoutSink([]string{"test"}, []Sink{backend}), nil
+	// workers are not started, the queued samples are processed below
+	ingest = newIngestPipeline(10, 1, QueueFullReject, processSample)
+
+	failures := parserStats().(map[string]interface{})["parse_failures"].(map[string]int64)["sample#tables"]
+
+	line := "<134>1 2024-04-28T00:03:49+00:00 host app heroku-postgres - source=DATABASE sample#db_size=90755887bytes sample#tables=four sample#load-avg-1m=0\n"
+	w := httptest.NewRecorder()
+	processLogs(w, httptest.NewRequest(http.MethodPost, "/log", strings.NewReader(fmt.Sprintf("%d %s", len(line), line))))
+	if w.Code != http.StatusOK || len(ingest.queue) != 1 {
+		t.Fatalf("unexpected status %v, %v samples queued", w.Code, len(ingest.queue))
+	}
+	processSample(<-ingest.queue)
+
+	expected := map[string]string{
+		"heroku_pg_stats": `{"dbsize":90755887,"load_1min":0}`,
+		"cpu_load":        `{"load_1min":0}`,
+	}
+	if len(backend.rows) != len(expected) {
+		t.Errorf("written %v rows, expected %v", len(backend.rows), len(expected))
+	}
+	for _, row := range backend.rows {
+		if string(row.data) != expected[row.metric] || row.dbname != "PGWATCH2_MONITOREDDB_MYTARGETDB_URL" {
+			t.Errorf("unexpected %v row of %v: %s", row.metric, row.dbname, row.data)
+		}
+	}
+
+	if parserStats().(map[string]interface{})["parse_failures"].(map[string]int64)["sample#tables"] != failures+1 {
+		t.Errorf("expected a parse failure for sample#tables")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// when set, the rates of the counter samples (current_transaction and db_size) are computed against the previous
+// sample of the same monitored db and stored next to the raw values
+const RatesEnv string = "HKPG_LOGDRAIN_RATES"
+
+// no rate is computed across two samples further apart than this, e.g. after a drain outage
+const RatesMaxGapEnv string = "HKPG_LOGDRAIN_RATES_MAX_GAP"
+
+// when set, the previous sample of each monitored db is read from the metrics DB, so that rates don't restart
+// from scratch after a restart of the dyno
+const RatesSeedEnv string = "HKPG_LOGDRAIN_RATES_SEED"
+
+const defaultRatesMaxGap time.Duration = 15 * time.Minute
+const ratesSeedTimeout time.Duration = 5 * time.Second
+
+const seedCountersQuery string = `select (data->>'currenttransaction')::int8, (data->>'dbsize')::int8, time
+from public.` + derivedMetric + ` where dbname = $1 and time < $2 order by time desc limit 1;`
+
+// the last value received of a counter
+type counterValue struct {
+	t  time.Time
+	v  int64
+	ok bool
+}
+
+// the counters of a monitored db
+type counterState struct {
+	xid    counterValue
+	dbsize counterValue
+}
+
+type rateTracker struct {
+	maxGap time.Duration
+	// returns the last stored counters of a monitored db, nil if seeding is disabled
+	seed func(dbname string, before time.Time) (*counterState, error)
+	// the ages of datfrozenxid, nil if they are not read
+	xidAges *xidAgeMonitor
+
+	mu     sync.Mutex
+	states map[string]*counterState // monitored db name -> counters
+	resets int64
+	gaps   int64
+	seeded int64
+}
+
+var counters = newRateTracker(envDuration(RatesMaxGapEnv, defaultRatesMaxGap))
+
+func init() {
+	counters.xidAges = xidAges
+}
+
+func newRateTracker(maxGap time.Duration) *rateTracker {
+	return &rateTracker{maxGap: maxGap, states: make(map[string]*counterState)}
+}
+
+// returns the rate fields of a sample of dbname, and records its counters as the previous sample of dbname.
+// A sample older than the previous one (e.g. delivered out of order) is ignored.
+// The wraparound proximity is added if the age of datfrozenxid of dbname is read, see XidAgeSourcesEnv.
+func (r *rateTracker) rates(dbname string, rl *herokuPostgresLog, t time.Time) map[string]interface{} {
+	xid, okXid := rl.intValue("currenttransaction")
+	dbsize, okDbsize := rl.intValue("dbsize")
+	if !okXid && !okDbsize {
+		return nil
+	}
+
+	r.seedOnce(dbname, t)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, ok := r.states[dbname]
+	if !ok {
+		state = &counterState{}
+		r.states[dbname] = state
+	}
+
+	fields := make(map[string]interface{})
+
+	if okXid && (!state.xid.ok || t.After(state.xid.t)) {
+		prev := state.xid
+		state.xid = counterValue{t: t, v: xid, ok: true}
+
+		switch {
+		case !prev.ok:
+		case xid < prev.v:
+			// the xid can't go backwards, the database has been replaced (e.g. restored from a backup)
+			r.resets++
+		case t.Sub(prev.t) > r.maxGap:
+			r.gaps++
+		default:
+			fields["tps"] = float64(xid-prev.v) / t.Sub(prev.t).Seconds()
+		}
+	}
+
+	if r.xidAges != nil {
+		if a, ok := r.xidAges.latest(dbname, t); ok {
+			fields["xidage"] = a.age
+			fields["xidwraparoundpercentage"] = float64(a.age) / xidWraparoundAge * 100
+			// over 100 the anti-wraparound autovacuum is running (or failing to advance datfrozenxid)
+			if a.freezeMaxAge > 0 {
+				fields["xidfreezemaxagepercentage"] = float64(a.age) / float64(a.freezeMaxAge) * 100
+			}
+		}
+	}
+
+	if okDbsize && (!state.dbsize.ok || t.After(state.dbsize.t)) {
+		prev := state.dbsize
+		state.dbsize = counterValue{t: t, v: dbsize, ok: true}
+
+		// the size can shrink (e.g. VACUUM FULL, dropped tables), so the growth is negative instead of being a reset
+		if prev.ok && t.Sub(prev.t) <= r.maxGap {
+			fields["dbgrowthbytesperhour"] = float64(dbsize-prev.v) / t.Sub(prev.t).Hours()
+		}
+	}
+
+	return fields
+}
+
+// reads the last stored counters of dbname the first time one of its samples is received
+func (r *rateTracker) seedOnce(dbname string, t time.Time) {
+	r.mu.Lock()
+	_, ok := r.states[dbname]
+	r.mu.Unlock()
+	if ok || r.seed == nil {
+		return
+	}
+
+	state, err := r.seed(dbname, t)
+	if err != nil {
+		fmt.Printf("unable to seed the counters of %v: %v\n", dbname, err)
+		return
+	}
+	if state == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.states[dbname]; !ok {
+		r.states[dbname] = state
+		r.seeded++
+	}
+}
+
+func (r *rateTracker) stats() interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return map[string]interface{}{
+		"tracked": len(r.states),
+		"resets":  r.resets,
+		"gaps":    r.gaps,
+		"seeded":  r.seeded,
+	}
+}
+
+// returns a seed func reading the last row of a monitored db stored in the metrics DB.
+// The query is not prepared, as the metric table may not exist yet.
+func storedCounters(s *store) func(dbname string, before time.Time) (*counterState, error) {
+	return func(dbname string, before time.Time) (*counterState, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), ratesSeedTimeout)
+		defer cancel()
+
+		var xid, dbsize sql.NullInt64
+		var t time.Time
+		err := s.withRetry(ctx, "seed counters", func(db *sql.DB) error {
+			return db.QueryRowContext(ctx, seedCountersQuery, dbname, before).Scan(&xid, &dbsize, &t)
+		})
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &counterState{
+			xid:    counterValue{t: t, v: xid.Int64, ok: xid.Valid},
+			dbsize: counterValue{t: t, v: dbsize.Int64, ok: dbsize.Valid},
+		}, nil
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateTracker(t *testing.T) {
+	r := newRateTracker(15 * time.Minute)
+	t0 := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+
+	if fields := r.rates("db", parseTestLogLine(t, "sample#current_transaction=1000 sample#db_size=1000bytes"), t0); fields["tps"] != nil || fields["dbgrowthbytesperhour"] != nil {
+		t.Errorf("unexpected rates for the first sample %v", fields)
+	}
+
+	fields := r.rates("db", parseTestLogLine(t, "sample#current_transaction=4000 sample#db_size=6000bytes"), t0.Add(5*time.Minute))
+	if fields["tps"] != 10.0 || fields["dbgrowthbytesperhour"] != 60000.0 || fields["xidage"] != nil {
+		t.Errorf("unexpected rates %v", fields)
+	}
+
+	// out of order
+	if fields := r.rates("db", parseTestLogLine(t, "sample#current_transaction=2000"), t0.Add(time.Minute)); len(fields) != 0 {
+		t.Errorf("unexpected rates for an out of order sample %v", fields)
+	}
+
+	// reset
+	fields = r.rates("db", parseTestLogLine(t, "sample#current_transaction=10 sample#db_size=3000bytes"), t0.Add(10*time.Minute))
+	if fields["tps"] != nil || fields["dbgrowthbytesperhour"] != -36000.0 {
+		t.Errorf("unexpected rates after a reset %v", fields)
+	}
+
+	// gap
+	fields = r.rates("db", parseTestLogLine(t, "sample#current_transaction=20 sample#db_size=4000bytes"), t0.Add(time.Hour))
+	if fields["tps"] != nil || fields["dbgrowthbytesperhour"] != nil {
+		t.Errorf("unexpected rates after a gap %v", fields)
+	}
+
+	if r.resets != 1 || r.gaps != 1 {
+		t.Errorf("unexpected resets[%v] gaps[%v]", r.resets, r.gaps)
+	}
+}
+
+func TestRateTrackerSeed(t *testing.T) {
+	t0 := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+
+	r := newRateTracker(15 * time.Minute)
+	r.seed = func(dbname string, before time.Time) (*counterState, error) {
+		return &counterState{xid: counterValue{t: t0, v: 1000, ok: true}}, nil
+	}
+
+	fields := r.rates("db", parseTestLogLine(t, "sample#current_transaction=1600"), t0.Add(time.Minute))
+	if fields["tps"] != 10.0 || r.seeded != 1 {
+		t.Errorf("unexpected rates after seeding %v", fields)
+	}
+}
+
+func TestRateTrackerXidAge(t *testing.T) {
+	t0 := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+
+	r := newRateTracker(15 * time.Minute)
+	r.xidAges = newXidAgeMonitor(nil, 5*time.Minute)
+	r.xidAges.ages["db"] = xidAge{t: t0, age: 1 << 30, freezeMaxAge: 200000000}
+
+	fields := r.rates("db", parseTestLogLine(t, "sample#current_transaction=1000"), t0.Add(time.Minute))
+	if fields["xidage"] != int64(1<<30) || fields["xidwraparoundpercentage"] != 50.0 {
+		t.Errorf("unexpected wraparound proximity %v", fields)
+	}
+	if p := fields["xidfreezemaxagepercentage"].(float64); p < 536 || p > 537 {
+		t.Errorf("unexpected autovacuum_freeze_max_age percentage %v", p)
+	}
+
+	// too old to be reported with the sample
+	if fields := r.rates("db", parseTestLogLine(t, "sample#current_transaction=2000"), t0.Add(time.Hour)); fields["xidage"] != nil {
+		t.Errorf("unexpected stale xid age %v", fields)
+	}
+}
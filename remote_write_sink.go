@@ -0,0 +1,339 @@
+// reference(s):
+// 	https://prometheus.io/docs/concepts/remote_write_spec/
+// 	https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto
+// 	https://github.com/prometheus/prometheus/blob/main/prompb/types.proto
+// 	https://protobuf.dev/programming-guides/encoding/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+const RemoteWriteSinkName string = "remote_write"
+
+// the remote write endpoint, e.g. http://victoriametrics:8428/api/v1/write or http://mimir/api/v1/push.
+// Basic auth credentials can be set in the URL.
+const RemoteWriteUrlEnv string = "HKPG_LOGDRAIN_REMOTE_WRITE_URL"
+const RemoteWriteBearerTokenEnv string = "HKPG_LOGDRAIN_REMOTE_WRITE_BEARER_TOKEN"
+
+// the max number of time series of a remote write request, a batch is split in several requests
+const RemoteWriteMaxSeriesEnv string = "HKPG_LOGDRAIN_REMOTE_WRITE_MAX_SERIES"
+const RemoteWriteMaxRetriesEnv string = "HKPG_LOGDRAIN_REMOTE_WRITE_MAX_RETRIES"
+const RemoteWriteTimeoutEnv string = "HKPG_LOGDRAIN_REMOTE_WRITE_TIMEOUT"
+
+const defaultRemoteWriteMaxSeries int = 500
+const defaultRemoteWriteMaxRetries int = 3
+const defaultRemoteWriteTimeout time.Duration = 30 * time.Second
+const remoteWriteBackoff time.Duration = time.Second
+
+// the prefix of the time series names, e.g. sample#load-avg-1m is written as heroku_pg_load_avg_1m
+const remoteWriteNamePrefix string = "heroku_pg_"
+
+// tags of the rows not written as labels, as they change from line to line
+var remoteWriteIgnoredTags = map[string]bool{"hostname": true, "name": true}
+
+var invalidPromNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// remoteWriteSink pushes the numeric fields of the rows as Prometheus time series, one sample per field, labelled
+// with the dbname and the tags of the row (e.g. addon and source). A field written to several metrics (e.g.
+// load_1min of heroku_pg_stats and cpu_load, both sample#load-avg-1m) is the same time series, so it's only sent once.
+type remoteWriteSink struct {
+	url         string
+	bearerToken string
+	maxSeries   int
+	maxRetries  int
+	backoff     time.Duration
+	client      *http.Client
+
+	// metric.field -> logfmt key, the series are named after the Heroku sample rather than the pgwatch2 field
+	keys map[string]string
+
+	requests atomic.Int64
+	series   atomic.Int64
+	retries  atomic.Int64
+	rejected atomic.Int64
+}
+
+func newRemoteWriteSinkFromEnv() (Sink, error) {
+	url := os.Getenv(RemoteWriteUrlEnv)
+	if url == "" {
+		return nil, fmt.Errorf("%v not set", RemoteWriteUrlEnv)
+	}
+
+	rs := newRemoteWriteSink(url, logMappings)
+	rs.bearerToken = os.Getenv(RemoteWriteBearerTokenEnv)
+	rs.maxSeries = envInt(RemoteWriteMaxSeriesEnv, defaultRemoteWriteMaxSeries)
+	rs.maxRetries = envInt(RemoteWriteMaxRetriesEnv, defaultRemoteWriteMaxRetries)
+	rs.client.Timeout = envDuration(RemoteWriteTimeoutEnv, defaultRemoteWriteTimeout)
+
+	registerStats("remote_write", rs.stats)
+	return rs, nil
+}
+
+func newRemoteWriteSink(url string, mappings logMapping) *remoteWriteSink {
+	rs := &remoteWriteSink{
+		url:        url,
+		maxSeries:  defaultRemoteWriteMaxSeries,
+		maxRetries: defaultRemoteWriteMaxRetries,
+		backoff:    remoteWriteBackoff,
+		client:     &http.Client{Timeout: defaultRemoteWriteTimeout},
+		keys:       make(map[string]string),
+	}
+
+	for _, samples := range mappings {
+		for key, sm := range samples {
+			for _, metric := range sm.Metrics {
+				rs.keys[metric+"."+sm.Field] = key
+			}
+		}
+	}
+	return rs
+}
+
+// returns the name of the time series of a field and whether it's named after a logfmt key: from its key if it's
+// mapped (or it's a key itself, as the fields of the extra metric), from the metric and field names otherwise
+// (e.g. the derived fields or the pgwatch2 compat metrics, where backends.total and psutil_mem.total must not collide)
+func (rs *remoteWriteSink) seriesName(metric, field string) (string, bool) {
+	key, ok := rs.keys[metric+"."+field]
+	if !ok {
+		for _, prefix := range l2metPrefixes {
+			if strings.HasPrefix(field, prefix) {
+				key, ok = field, true
+			}
+		}
+	}
+
+	name := strings.TrimPrefix(metric, remoteWriteNamePrefix) + "_" + field
+	if ok {
+		name = key
+		for _, prefix := range l2metPrefixes {
+			name = strings.TrimPrefix(name, prefix)
+		}
+	}
+
+	name = strings.Trim(invalidPromNameChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	return remoteWriteNamePrefix + strings.TrimPrefix(name, remoteWriteNamePrefix), ok
+}
+
+type promLabel struct {
+	name, value string
+}
+
+type promSeries struct {
+	labels    []promLabel
+	value     float64
+	timestamp int64 // milliseconds since epoch
+}
+
+// converts the rows into time series, the non numeric fields (e.g. the units of the extra metric) are skipped
+func (rs *remoteWriteSink) toSeries(rows []metricRow) []promSeries {
+	var series []promSeries
+	seen := make(map[string]bool)
+
+	for _, row := range rows {
+		var data map[string]interface{}
+		if err := json.Unmarshal(row.data, &data); err != nil {
+			fmt.Printf("remote write: invalid %v data: %v\n", row.metric, err)
+			continue
+		}
+
+		labels := []promLabel{{name: "dbname", value: row.dbname}}
+		if row.tags != nil {
+			var tags map[string]string
+			if err := json.Unmarshal(row.tags, &tags); err != nil {
+				fmt.Printf("remote write: invalid %v tags: %v\n", row.metric, err)
+			}
+			for k, v := range tags {
+				k = invalidPromNameChars.ReplaceAllString(k, "_")
+				if !remoteWriteIgnoredTags[k] && k != "dbname" && !strings.HasPrefix(k, "__") {
+					labels = append(labels, promLabel{name: k, value: v})
+				}
+			}
+		}
+
+		for field, v := range data {
+			value, ok := v.(float64)
+			if !ok {
+				continue
+			}
+
+			name, fromKey := rs.seriesName(row.metric, field)
+			s := promSeries{
+				labels:    append([]promLabel{{name: "__name__", value: name}}, labels...),
+				value:     value,
+				timestamp: row.time.UnixMilli(),
+			}
+			// the labels must be sorted by name
+			sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+
+			// a logfmt key mapped to several metrics is sent once
+			if fromKey {
+				var id strings.Builder
+				for _, l := range s.labels {
+					id.WriteString(l.name + "=" + l.value + ",")
+				}
+				id.WriteString(fmt.Sprint(s.timestamp))
+				if seen[id.String()] {
+					continue
+				}
+				seen[id.String()] = true
+			}
+
+			series = append(series, s)
+		}
+	}
+	return series
+}
+
+// appends a length-delimited field (wire type 2)
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// encodes a prometheus.WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []promSeries) []byte {
+	var req, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = appendBytesField(msg[:0], 1, []byte(l.name))
+			msg = appendBytesField(msg, 2, []byte(l.value))
+			ts = appendBytesField(ts, 1, msg)
+		}
+
+		// value is a fixed64 (wire type 1), timestamp a varint (wire type 0)
+		msg = binary.AppendUvarint(msg[:0], 1<<3|1)
+		msg = binary.LittleEndian.AppendUint64(msg, math.Float64bits(s.value))
+		msg = binary.AppendUvarint(msg, 2<<3|0)
+		msg = binary.AppendUvarint(msg, uint64(s.timestamp))
+		ts = appendBytesField(ts, 2, msg)
+
+		req = appendBytesField(req, 1, ts)
+	}
+	return req
+}
+
+// rows are pushed in requests of at most maxSeries time series, each request is retried on the errors the spec
+// defines as retryable (5xx and 429), the others are rejected by the receiver and dropped
+func (rs *remoteWriteSink) WriteBatch(ctx context.Context, rows []metricRow) error {
+	series := rs.toSeries(rows)
+	for len(series) > 0 {
+		n := len(series)
+		if rs.maxSeries > 0 && n > rs.maxSeries {
+			n = rs.maxSeries
+		}
+
+		if err := rs.push(ctx, series[:n]); err != nil {
+			return err
+		}
+		series = series[n:]
+	}
+	return nil
+}
+
+func (rs *remoteWriteSink) push(ctx context.Context, series []promSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+
+	backoff := rs.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		if retryable, err = rs.post(ctx, body); err == nil {
+			rs.requests.Add(1)
+			rs.series.Add(int64(len(series)))
+			return nil
+		}
+
+		if !retryable && ctx.Err() == nil {
+			rs.rejected.Add(int64(len(series)))
+			fmt.Printf("remote write: %v series rejected: %v\n", len(series), err)
+			return nil
+		}
+		if attempt >= rs.maxRetries || ctx.Err() != nil {
+			return &retryableSinkError{err: err}
+		}
+
+		rs.retries.Add(1)
+		if isEnv(DebugEnv) {
+			fmt.Printf("[remote_write_sink.go:push] retrying in %v: %v\n", backoff, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return &retryableSinkError{err: err}
+		}
+		backoff *= 2
+	}
+}
+
+// returns whether the request can be retried if it fails
+func (rs *remoteWriteSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rs.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "heroku-pg-logdrain-to-pgwatch2-metrics")
+	if rs.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rs.bearerToken)
+	}
+
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// rows are pushed by WriteBatch
+func (rs *remoteWriteSink) Flush(_ context.Context) error {
+	return nil
+}
+
+func (rs *remoteWriteSink) Close(_ context.Context) error {
+	rs.client.CloseIdleConnections()
+	return nil
+}
+
+func (rs *remoteWriteSink) stats() interface{} {
+	return map[string]interface{}{
+		"requests": rs.requests.Load(),
+		"series":   rs.series.Load(),
+		"retries":  rs.retries.Load(),
+		"rejected": rs.rejected.Load(),
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// decodes the fields of a protobuf message, field number -> values (the bytes of length-delimited fields, the
+// fixed64 and varint values as uint64)
+func decodeProtoFields(t *testing.T, b []byte) map[int][]interface{} {
+	fields := make(map[int][]interface{})
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			fields[int(tag>>3)] = append(fields[int(tag>>3)], v)
+			b = b[n:]
+		case 1:
+			fields[int(tag>>3)] = append(fields[int(tag>>3)], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			fields[int(tag>>3)] = append(fields[int(tag>>3)], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %v", tag&7)
+		}
+	}
+	return fields
+}
+
+// decodes a WriteRequest into the labels and the sample of each time series
+func decodeWriteRequest(t *testing.T, b []byte) []promSeries {
+	var series []promSeries
+	for _, ts := range decodeProtoFields(t, b)[1] {
+		fields := decodeProtoFields(t, ts.([]byte))
+
+		var s promSeries
+		for _, l := range fields[1] {
+			label := decodeProtoFields(t, l.([]byte))
+			s.labels = append(s.labels, promLabel{name: string(label[1][0].([]byte)), value: string(label[2][0].([]byte))})
+		}
+		sample := decodeProtoFields(t, fields[2][0].([]byte))
+		s.value = math.Float64frombits(sample[1][0].(uint64))
+		s.timestamp = int64(sample[2][0].(uint64))
+
+		series = append(series, s)
+	}
+	return series
+}
+
+type remoteWriteReceiver struct {
+	mu       sync.Mutex
+	failures int // the requests answered with a 503 before accepting them
+	requests int
+	series   []promSeries
+}
+
+func (rr *remoteWriteReceiver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rr.mu.Lock()
+		defer rr.mu.Unlock()
+
+		rr.requests++
+		if rr.failures > 0 {
+			rr.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Errorf("invalid snappy body: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rr.series = append(rr.series, decodeWriteRequest(t, b)...)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	receiver := &remoteWriteReceiver{failures: 1}
+	srv := httptest.NewServer(receiver.handler(t))
+	defer srv.Close()
+
+	mappings, err := buildLogMapping(defaultLogMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := newRemoteWriteSink(srv.URL, mappings)
+	rs.backoff = time.Millisecond
+	rs.maxSeries = 2
+
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	tags := []byte(`{"addon": "postgresql-round-12345", "source": "DATABASE", "hostname": "host", "name": "app"}`)
+	rows := []metricRow{
+		{metric: "heroku_pg_stats", time: now, dbname: "mydb", data: []byte(`{"load_1min": 0.5, "dbsize": 1024}`), tags: tags},
+		// the same series of heroku_pg_stats, sent once
+		{metric: "cpu_load", time: now, dbname: "mydb", data: []byte(`{"load_1min": 0.5}`), tags: tags},
+		{metric: "heroku_pg_extra", time: now, dbname: "mydb", data: []byte(`{"sample#new-key": 3, "units": {"sample#new-key": "kB"}}`)},
+		// fields without a logfmt key are named after their metric too
+		{metric: "backends", time: now, dbname: "mydb", data: []byte(`{"total": 15}`)},
+		{metric: "psutil_mem", time: now, dbname: "mydb", data: []byte(`{"total": 4039151616}`)},
+		{metric: "heroku_pg_stats", time: now, dbname: "mydb", data: []byte(`{"memoryusedpercentage": 98.1}`)},
+	}
+
+	if err := rs.WriteBatch(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+
+	// 6 series in 3 requests, the first one retried
+	if receiver.requests != 4 || len(receiver.series) != 6 {
+		t.Fatalf("unexpected requests %v and series %v", receiver.requests, receiver.series)
+	}
+
+	values := make(map[string]promSeries)
+	for _, s := range receiver.series {
+		if s.labels[0].name != "__name__" {
+			t.Errorf("expected the labels to be sorted, got %v", s.labels)
+		}
+		values[s.labels[0].value] = s
+	}
+
+	load, ok := values["heroku_pg_load_avg_1m"]
+	if !ok || load.value != 0.5 || load.timestamp != now.UnixMilli() {
+		t.Errorf("unexpected series %v", values)
+	}
+	expected := []promLabel{{"__name__", "heroku_pg_load_avg_1m"}, {"addon", "postgresql-round-12345"}, {"dbname", "mydb"}, {"source", "DATABASE"}}
+	if len(load.labels) != len(expected) {
+		t.Fatalf("unexpected labels %v", load.labels)
+	}
+	for i, l := range expected {
+		if load.labels[i] != l {
+			t.Errorf("expected label %v, got %v", l, load.labels[i])
+		}
+	}
+
+	if values["heroku_pg_db_size"].value != 1024 || values["heroku_pg_new_key"].value != 3 {
+		t.Errorf("unexpected series %v", values)
+	}
+	if values["heroku_pg_backends_total"].value != 15 || values["heroku_pg_psutil_mem_total"].value != 4039151616 ||
+		values["heroku_pg_stats_memoryusedpercentage"].value != 98.1 {
+		t.Errorf("unexpected series %v", values)
+	}
+}
+
+func TestRemoteWriteSinkErrors(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	rs := newRemoteWriteSink(srv.URL, nil)
+	rs.backoff = time.Millisecond
+	rows := []metricRow{{metric: "heroku_pg_stats", time: time.Now(), dbname: "mydb", data: []byte(`{"dbsize": 1024}`)}}
+
+	// retryable, the batch writer spools the rows
+	if err := rs.WriteBatch(context.Background(), rows); err == nil || classifyError(err) != errorRetryable {
+		t.Errorf("expected a retryable error after %v retries, got %v", rs.maxRetries, err)
+	}
+	if rs.retries.Load() != int64(rs.maxRetries) {
+		t.Errorf("expected %v retries, got %v", rs.maxRetries, rs.retries.Load())
+	}
+
+	// rejected by the receiver, retrying would fail again
+	status = http.StatusBadRequest
+	if err := rs.WriteBatch(context.Background(), rows); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if rs.rejected.Load() != 1 {
+		t.Errorf("expected 1 rejected series, got %v", rs.rejected.Load())
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const RetentionEnv string = "HKPG_LOGDRAIN_RETENTION"
+const RetentionIntervalEnv string = "HKPG_LOGDRAIN_RETENTION_INTERVAL"
+const RetentionDryRunEnv string = "HKPG_LOGDRAIN_RETENTION_DRY_RUN"
+
+const defaultRetentionInterval time.Duration = 6 * time.Hour
+
+// the retention applied to the metrics without their own, e.g. {"heroku_pg_stats": "90d", "*": "30d"}
+const retentionDefaultKey string = "*"
+
+// leaf partitions of a metric table with their bounds, it works for any level of sub-partitioning
+const listPartitionsQuery string = `select c.oid::regclass::text, coalesce(pg_get_expr(c.relpartbound, c.oid), '')
+from pg_partition_tree(to_regclass($1)) t join pg_class c on c.oid = t.relid
+where t.isleaf and t.level > 0;`
+
+var partitionBoundRegexp = regexp.MustCompile(`FOR VALUES FROM \('([^']+)'\) TO \('([^']+)'\)`)
+
+// retentionJob drops the partitions of a metric whose time range is entirely older than the metric retention period.
+// In dry-run mode the partitions that would be dropped are only logged.
+type retentionJob struct {
+	store      *store
+	partitions *partitionManager
+	retention  map[string]time.Duration // metric name (or retentionDefaultKey) -> retention period
+	dryRun     bool
+
+	mu         sync.Mutex
+	lastRun    time.Time
+	candidates []string
+
+	droppedCount atomic.Int64
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// parses a retention period, besides the time.ParseDuration units it accepts days (30d) and weeks (4w)
+func parseRetention(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(v, suffix) {
+			i, err := strconv.Atoi(strings.TrimSuffix(v, suffix))
+			if err != nil {
+				return 0, fmt.Errorf("invalid retention %v: %w", v, err)
+			}
+			return time.Duration(i) * unit, nil
+		}
+	}
+
+	return time.ParseDuration(v)
+}
+
+// parses the retention config, e.g. {"heroku_pg_stats": "90d", "cpu_load": "2w", "*": "30d"}
+func parseRetentionConfig(config string) (map[string]time.Duration, error) {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(config), &raw); err != nil {
+		return nil, err
+	}
+
+	retention := make(map[string]time.Duration, len(raw))
+	for metric, v := range raw {
+		d, err := parseRetention(v)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid retention %v for %v, it must be positive", v, metric)
+		}
+		retention[metric] = d
+	}
+	return retention, nil
+}
+
+// parses the upper bound of a range partition, e.g. FOR VALUES FROM ('2024-04-22 00:00:00+00') TO ('2024-04-29 00:00:00+00')
+// ok is false for partitions without a time range (e.g. DEFAULT or list partitions)
+func partitionUpperBound(bound string) (time.Time, bool) {
+	m := partitionBoundRegexp.FindStringSubmatch(bound)
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	// the offset format depends on the session time zone
+	for _, layout := range []string{"2006-01-02 15:04:05-07", "2006-01-02 15:04:05-07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, m[2]); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func newRetentionJob(store *store, partitions *partitionManager, retention map[string]time.Duration, dryRun bool) *retentionJob {
+	return &retentionJob{
+		store:      store,
+		partitions: partitions,
+		retention:  retention,
+		dryRun:     dryRun,
+		stopCh:     make(chan struct{}),
+	}
+}
+
+// the metrics written by the drain plus the ones with their own retention
+func (rj *retentionJob) metrics() []string {
+	set := make(map[string]bool)
+	for _, metric := range rj.partitions.metrics() {
+		set[metric] = true
+	}
+	for metric := range rj.retention {
+		if metric != retentionDefaultKey {
+			set[metric] = true
+		}
+	}
+
+	metrics := make([]string, 0, len(set))
+	for metric := range set {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	return metrics
+}
+
+func (rj *retentionJob) run() {
+	var candidates []string
+
+	for _, metric := range rj.metrics() {
+		retention, ok := rj.retention[metric]
+		if !ok {
+			if retention, ok = rj.retention[retentionDefaultKey]; !ok {
+				continue
+			}
+		}
+		cutoff := time.Now().Add(-retention)
+
+		expired, err := rj.expiredPartitions(metric, cutoff)
+		if err != nil {
+			fmt.Printf("DB error: unable to list %v partitions: %v\n", metric, err)
+			continue
+		}
+
+		for _, name := range expired {
+			if rj.dryRun {
+				fmt.Printf("retention (dry-run): would drop partition %v of %v, older than %v\n", name, metric, retention)
+				candidates = append(candidates, name)
+				continue
+			}
+
+			// serialized with the partitions creation and the retention jobs of the other dynos
+			if err := withAdvisoryLock(context.Background(), rj.store, "partitions:"+metric, func(tx *sql.Tx) error {
+				_, err := tx.Exec("drop table if exists " + name)
+				return err
+			}); err != nil {
+				fmt.Printf("DB error: unable to drop partition %v: %v\n", name, err)
+				continue
+			}
+			rj.droppedCount.Add(1)
+			// a late sample for a dropped week must ensure its partition again
+			rj.partitions.forget(metric)
+			fmt.Printf("retention: dropped partition %v of %v, older than %v\n", name, metric, retention)
+		}
+	}
+
+	rj.mu.Lock()
+	rj.lastRun = time.Now()
+	rj.candidates = candidates
+	rj.mu.Unlock()
+}
+
+// returns the leaf partitions of metric whose upper bound is not after cutoff
+func (rj *retentionJob) expiredPartitions(metric string, cutoff time.Time) ([]string, error) {
+	var expired []string
+
+	err := rj.store.withRetry(context.Background(), "list "+metric+" partitions", func(db *sql.DB) error {
+		expired = nil
+
+		rows, err := db.Query(listPartitionsQuery, "public."+metric)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name, bound string
+			if err := rows.Scan(&name, &bound); err != nil {
+				return err
+			}
+			if upper, ok := partitionUpperBound(bound); ok && !upper.After(cutoff) {
+				expired = append(expired, name)
+			}
+		}
+		return rows.Err()
+	})
+
+	return expired, err
+}
+
+func (rj *retentionJob) start(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+
+	rj.wg.Add(1)
+	go func() {
+		defer rj.wg.Done()
+
+		rj.run()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				rj.run()
+			case <-rj.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (rj *retentionJob) close() {
+	close(rj.stopCh)
+	rj.wg.Wait()
+}
+
+func (rj *retentionJob) stats() interface{} {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+
+	retention := make(map[string]string, len(rj.retention))
+	for metric, d := range rj.retention {
+		retention[metric] = d.String()
+	}
+
+	return map[string]interface{}{
+		"retention":  retention,
+		"dry_run":    rj.dryRun,
+		"last_run":   rj.lastRun,
+		"dropped":    rj.droppedCount.Load(),
+		"candidates": rj.candidates,
+	}
+}
+
+// returns the retention job configured by the env, or nil if retention is not enabled
+func newRetentionJobFromEnv(store *store, partitions *partitionManager) *retentionJob {
+	config, ok := os.LookupEnv(RetentionEnv)
+	if !ok {
+		return nil
+	}
+
+	retention, err := parseRetentionConfig(config)
+	if err != nil {
+		fmt.Printf("invalid %v value[%v], retention disabled: %v\n", RetentionEnv, config, err)
+		return nil
+	}
+
+	return newRetentionJob(store, partitions, retention, isEnv(RetentionDryRunEnv))
+}
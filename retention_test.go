@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetentionConfig(t *testing.T) {
+	retention, err := parseRetentionConfig(`{"heroku_pg_stats": "90d", "cpu_load": "2w", "*": "720h"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retention["heroku_pg_stats"] != 90*24*time.Hour || retention["cpu_load"] != 14*24*time.Hour || retention[retentionDefaultKey] != 30*24*time.Hour {
+		t.Errorf("unexpected retention %v", retention)
+	}
+
+	for _, config := range []string{`{"cpu_load": "xd"}`, `{"cpu_load": "-1h"}`, `["cpu_load"]`} {
+		if _, err := parseRetentionConfig(config); err == nil {
+			t.Errorf("expected an error for %v", config)
+		}
+	}
+}
+
+func TestPartitionUpperBound(t *testing.T) {
+	upper, ok := partitionUpperBound("FOR VALUES FROM ('2024-04-22 00:00:00+00') TO ('2024-04-29 00:00:00+00')")
+	if !ok || !upper.Equal(time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected upper bound %v %v", upper, ok)
+	}
+
+	upper, ok = partitionUpperBound("FOR VALUES FROM ('2024-04-22 02:00:00+02') TO ('2024-04-29 05:30:00+05:30')")
+	if !ok || !upper.Equal(time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected upper bound %v %v", upper, ok)
+	}
+
+	for _, bound := range []string{"DEFAULT", "FOR VALUES IN ('PGWATCH2_MONITOREDDB_MYTARGETDB_URL')", "FOR VALUES FROM (MINVALUE) TO (MAXVALUE)"} {
+		if _, ok := partitionUpperBound(bound); ok {
+			t.Errorf("expected no upper bound for %v", bound)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// the sinks the metrics are written to, comma separated, e.g. pgwatch2
+const SinksEnv string = "HKPG_LOGDRAIN_SINKS"
+
+const defaultSinks string = Pgwatch2SinkName
+
+// Sink is a backend the metric rows are written to, the writes are interrupted once ctx is done
+type Sink interface {
+	// writes a batch of rows, a sink may buffer them until Flush
+	WriteBatch(ctx context.Context, rows []metricRow) error
+	// writes the buffered rows, if any
+	Flush(ctx context.Context) error
+	// flushes and releases the resources of the sink, ctx is the shutdown deadline
+	Close(ctx context.Context) error
+}
+
+// implemented by the sinks that connect to their backend (or start background jobs) at startup, see startMetricsDB
+type sinkOpener interface {
+	open(ctx context.Context) error
+}
+
+// implemented by the sinks whose backend can be checked before replaying the spooled rows
+type readinessChecker interface {
+	ping(ctx context.Context) error
+}
+
+// a transient error of a sink not backed by a DB (e.g. a 503 of a remote write endpoint), so that its rows are spooled
+// and replayed as the rows of the DB sinks, see classifyError
+type retryableSinkError struct {
+	err error
+}
+
+func (e *retryableSinkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableSinkError) Unwrap() error {
+	return e.err
+}
+
+// sink name -> constructor reading the sink config from the env
+var sinkFactories = map[string]func() (Sink, error){
+	Pgwatch2SinkName:    newPgwatch2SinkFromEnv,
+	Pgwatch3SinkName:    newPgwatch3SinkFromEnv,
+	TimescaleSinkName:   newTimescaleSinkFromEnv,
+	RemoteWriteSinkName: newRemoteWriteSinkFromEnv,
+}
+
+// returns the names of the configured sinks, without duplicates
+func sinkNames() []string {
+	v, ok := os.LookupEnv(SinksEnv)
+	if !ok || strings.TrimSpace(v) == "" {
+		v = defaultSinks
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func sinkEnabled(name string) bool {
+	for _, n := range sinkNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// groups the rows by metric for the sinks writing a batch per metric, the metrics and their rows keep their order
+func groupRowsByMetric(rows []metricRow) ([]string, map[string][]metricRow) {
+	var metrics []string
+	byMetric := make(map[string][]metricRow)
+	for _, row := range rows {
+		if _, ok := byMetric[row.metric]; !ok {
+			metrics = append(metrics, row.metric)
+		}
+		byMetric[row.metric] = append(byMetric[row.metric], row)
+	}
+	return metrics, byMetric
+}
+
+// fanoutSink writes the rows to several sinks, a failing sink doesn't stop the others from being written.
+// Each sink is expected to be behind its own batch writer (see newSinksFromEnv), so that its failed rows are spooled
+// and replayed for that sink only.
+type fanoutSink struct {
+	names    []string
+	sinks    []Sink
+	failures []atomic.Int64
+}
+
+func newFanoutSink(names []string, sinks []Sink) *fanoutSink {
+	return &fanoutSink{names: names, sinks: sinks, failures: make([]atomic.Int64, len(sinks))}
+}
+
+// runs op on every sink and returns an error reporting the sinks it failed on, if any
+func (fs *fanoutSink) each(opName string, op func(Sink) error) error {
+	var failed []string
+	for i, sink := range fs.sinks {
+		if err := op(sink); err != nil {
+			fs.failures[i].Add(1)
+			fmt.Printf("sink %v: unable to %v: %v\n", fs.names[i], opName, err)
+			failed = append(failed, fs.names[i]+": "+err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%v of %v sinks failed to %v: %v", len(failed), len(fs.sinks), opName, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (fs *fanoutSink) WriteBatch(ctx context.Context, rows []metricRow) error {
+	return fs.each("write", func(s Sink) error { return s.WriteBatch(ctx, rows) })
+}
+
+func (fs *fanoutSink) Flush(ctx context.Context) error {
+	return fs.each("flush", func(s Sink) error { return s.Flush(ctx) })
+}
+
+func (fs *fanoutSink) Close(ctx context.Context) error {
+	return fs.each("close", func(s Sink) error { return s.Close(ctx) })
+}
+
+func (fs *fanoutSink) stats() interface{} {
+	failures := make(map[string]int64, len(fs.sinks))
+	dropped := make(map[string]int64, len(fs.sinks))
+	pending := make(map[string]int, len(fs.sinks))
+	overflowed := make(map[string]int64, len(fs.sinks))
+	for i, name := range fs.names {
+		failures[name] = fs.failures[i].Load()
+		if bw, ok := fs.sinks[i].(*batchWriter); ok {
+			dropped[name] = bw.dropped.Load()
+			overflowed[name] = bw.overflowed.Load()
+			bw.mu.Lock()
+			pending[name] = bw.pending
+			bw.mu.Unlock()
+		}
+	}
+	return map[string]interface{}{"sinks": fs.names, "failures": failures, "dropped": dropped, "pending": pending, "overflowed": overflowed}
+}
+
+// builds the configured sinks, each one behind its own batch writer and spool, fanned out by the returned sink.
+// The spool of the pgwatch2 sink is the spool dir itself, the others have their own sub-directory.
+func newSinksFromEnv() (*fanoutSink, []*batchWriter, error) {
+	var names []string
+	var sinks []Sink
+	var writers []*batchWriter
+
+	for _, name := range sinkNames() {
+		factory, ok := sinkFactories[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown sink %v in %v", name, SinksEnv)
+		}
+		backend, err := factory()
+		if err != nil {
+			return nil, nil, fmt.Errorf("sink %v: %w", name, err)
+		}
+
+		bw := newBatchWriter(backend, envInt(BatchSizeEnv, defaultBatchSize), envInt(BatchMaxPendingEnv, defaultBatchMaxPending), envDuration(BatchFlushIntervalEnv, defaultBatchFlushInterval))
+
+		// the spool is optional, without it the rows that can't be written are lost
+		if dir, ok := os.LookupEnv(SpoolDirEnv); ok {
+			statsName := "spool"
+			if name != Pgwatch2SinkName {
+				dir = filepath.Join(dir, name)
+				statsName = "spool_" + name
+			}
+
+			bw.spool, err = openSpool(dir, envInt(SpoolMaxBytesEnv, defaultSpoolMaxBytes), envDuration(SpoolMaxAgeEnv, defaultSpoolMaxAge), envInt(SpoolSegmentBytesEnv, defaultSpoolSegmentBytes))
+			if err != nil {
+				fmt.Printf("Unable to open spool dir %v: %v\n", dir, err)
+			} else {
+				bw.replayInterval = envDuration(SpoolReplayIntervalEnv, defaultSpoolReplayInterval)
+				registerStats(statsName, bw.spool.stats)
+			}
+		}
+
+		names = append(names, name)
+		sinks = append(sinks, bw)
+		writers = append(writers, bw)
+	}
+
+	return newFanoutSink(names, sinks), writers, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// a sink recording the rows written, it fails while err is set
+type testSink struct {
+	rows    []metricRow
+	flushes int
+	closed  bool
+	err     error
+}
+
+func (ts *testSink) WriteBatch(_ context.Context, rows []metricRow) error {
+	if ts.err != nil {
+		return ts.err
+	}
+	ts.rows = append(ts.rows, rows...)
+	return nil
+}
+
+func (ts *testSink) Flush(_ context.Context) error {
+	ts.flushes++
+	return nil
+}
+
+func (ts *testSink) Close(_ context.Context) error {
+	ts.closed = true
+	return nil
+}
+
+func TestFanoutSinkFailureIsolation(t *testing.T) {
+	ok, failing := &testSink{}, &testSink{err: errors.New("unreachable")}
+	fs := newFanoutSink([]string{"ok", "failing"}, []Sink{ok, failing})
+
+	if err := fs.WriteBatch(context.Background(), newTestRows("heroku_pg_stats", 2)); err == nil {
+		t.Errorf("expected an error for the failing sink")
+	}
+	if len(ok.rows) != 2 {
+		t.Errorf("written %v rows to the working sink, expected 2", len(ok.rows))
+	}
+	if fs.failures[0].Load() != 0 || fs.failures[1].Load() != 1 {
+		t.Errorf("unexpected failures %v %v", fs.failures[0].Load(), fs.failures[1].Load())
+	}
+
+	if err := fs.Close(context.Background()); err != nil || !ok.closed || !failing.closed {
+		t.Errorf("expected all the sinks to be closed: %v", err)
+	}
+}
+
+func TestBatchWriterSpoolsFailedRows(t *testing.T) {
+	backend := &testSink{err: syscall.ECONNREFUSED}
+	bw := newBatchWriter(backend, 10, 0, 0)
+
+	var err error
+	if bw.spool, err = openSpool(t.TempDir(), 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = bw.WriteBatch(context.Background(), newTestRows("heroku_pg_stats", 3))
+	if err := bw.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bw.spool.spooled.Load() != 3 {
+		t.Fatalf("spooled %v rows, expected 3", bw.spool.spooled.Load())
+	}
+	if backend.flushes != 1 {
+		t.Errorf("flushed the sink %v times, expected 1", backend.flushes)
+	}
+
+	backend.err = nil
+	bw.spool.close()
+	bw.replaySpool()
+	if len(backend.rows) != 3 || bw.spool.replayed.Load() != 3 {
+		t.Errorf("replayed %v rows, expected 3", len(backend.rows))
+	}
+}
+
+func TestBatchWriterSpoolsDeferredErrors(t *testing.T) {
+	// no partition for the rows, e.g. its ensure failed while the DB was unreachable
+	backend := &testSink{err: &pq.Error{Code: "23514"}}
+	bw := newBatchWriter(backend, 10, 0, 0)
+
+	var err error
+	if bw.spool, err = openSpool(t.TempDir(), 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = bw.WriteBatch(context.Background(), newTestRows("heroku_pg_stats", 3))
+	bw.flush(context.Background())
+	if bw.spool.spooled.Load() != 3 || bw.dropped.Load() != 0 {
+		t.Errorf("spooled %v dropped %v, expected 3 and 0", bw.spool.spooled.Load(), bw.dropped.Load())
+	}
+}
+
+func TestBatchWriterDropsFatalErrors(t *testing.T) {
+	backend := &testSink{err: errors.New("null value in column violates not-null constraint")}
+	bw := newBatchWriter(backend, 10, 0, 0)
+
+	var err error
+	if bw.spool, err = openSpool(t.TempDir(), 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = bw.WriteBatch(context.Background(), newTestRows("heroku_pg_stats", 3))
+	if err := bw.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bw.spool.spooled.Load() != 0 || bw.dropped.Load() != 3 {
+		t.Errorf("spooled %v dropped %v, expected 0 and 3", bw.spool.spooled.Load(), bw.dropped.Load())
+	}
+}
+
+func TestBatchWriterOverflow(t *testing.T) {
+	slow, fast := newBatchWriter(&blockingSink{}, 2, 2, 0), newBatchWriter(&testSink{}, 2, 2, 0)
+	fs := newFanoutSink([]string{"slow", "fast"}, []Sink{slow, fast})
+
+	var err error
+	if slow.spool, err = openSpool(t.TempDir(), 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = fs.WriteBatch(context.Background(), newTestRows("heroku_pg_stats", 2))
+	fast.flush(context.Background())
+
+	// maxPending rows are pending for the slow sink, the write doesn't wait for them and the fast sink is written
+	written := make(chan struct{})
+	go func() {
+		_ = fs.WriteBatch(context.Background(), newTestRows("heroku_pg_stats", 1))
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the write not to wait for the slow sink")
+	}
+	if slow.overflowed.Load() != 1 || slow.spool.spooled.Load() != 1 || slow.pending != 2 {
+		t.Errorf("overflowed %v spooled %v pending %v, expected 1, 1 and 2", slow.overflowed.Load(), slow.spool.spooled.Load(), slow.pending)
+	}
+	if fast.pending != 1 || fast.overflowed.Load() != 0 {
+		t.Errorf("pending %v overflowed %v for the fast sink, expected 1 and 0", fast.pending, fast.overflowed.Load())
+	}
+
+	// without a spool the rows are dropped
+	slow.spool = nil
+	_ = slow.WriteBatch(context.Background(), newTestRows("heroku_pg_stats", 1))
+	if slow.dropped.Load() != 1 {
+		t.Errorf("dropped %v rows, expected 1", slow.dropped.Load())
+	}
+}
+
+// a sink whose writes hang until their ctx is done
+type blockingSink struct {
+	testSink
+}
+
+func (bs *blockingSink) WriteBatch(ctx context.Context, rows []metricRow) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBatchWriterCloseDeadline(t *testing.T) {
+	bw := newBatchWriter(&blockingSink{}, 10, 0, time.Hour)
+
+	var err error
+	if bw.spool, err = openSpool(t.TempDir(), 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	bw.start()
+
+	_ = bw.WriteBatch(context.Background(), append(newTestRows("heroku_pg_stats", 2), newTestRows("cpu_load", 1)...))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_ = bw.Close(ctx)
+	if time.Since(start) > time.Second {
+		t.Errorf("expected the close to stop at the deadline, it took %v", time.Since(start))
+	}
+	if bw.spool.spooled.Load() != 3 {
+		t.Errorf("spooled %v rows, expected the 3 rows not written by the deadline", bw.spool.spooled.Load())
+	}
+}
+
+func TestSinkNames(t *testing.T) {
+	t.Setenv(SinksEnv, "pgwatch2, prometheus,,pgwatch2")
+	if names := sinkNames(); len(names) != 2 || names[0] != "pgwatch2" || names[1] != "prometheus" {
+		t.Errorf("unexpected sink names %v", names)
+	}
+
+	t.Setenv(SinksEnv, "")
+	if names := sinkNames(); len(names) != 1 || names[0] != Pgwatch2SinkName {
+		t.Errorf("unexpected default sink names %v", names)
+	}
+}
@@ -0,0 +1,350 @@
+// reference(s):
+// 	https://devcenter.heroku.com/articles/log-drains#https-drains
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rules matching the log lines on the drain token, the addon and the source, so that a single drain can serve the
+// databases of several apps, e.g.
+// [{"drain_token": "d.01234567-89ab-cdef-0123-456789abcdef", "source": "DATABASE", "dbname": "PGWATCH2_MONITOREDDB_APP1_URL"},
+// {"addon": "postgresql-defined-24903", "dbname": "PGWATCH2_MONITOREDDB_APP2_URL"}]
+const SourceRulesEnv string = "HKPG_LOGDRAIN_SOURCE_RULES"
+
+// when set, the sources config is read from this JSON file instead of SOURCES and HKPG_LOGDRAIN_SOURCE_RULES, e.g.
+// {"sources": {"DATABASE": "PGWATCH2_MONITOREDDB_MYTARGETDB_URL"}, "rules": [{"addon": "postgresql-defined-24903", "dbname": "PGWATCH2_MONITOREDDB_2_URL"}]}
+// The file is reloaded when it changes and on SIGHUP, the config of a dyno can be replaced by a POST to /sources as well.
+const SourcesFileEnv string = "HKPG_LOGDRAIN_SOURCES_FILE"
+const SourcesFilePollIntervalEnv string = "HKPG_LOGDRAIN_SOURCES_FILE_POLL_INTERVAL"
+
+const defaultSourcesFilePollInterval time.Duration = 30 * time.Second
+
+// the max size of a sources config posted to /sources
+const maxSourcesConfigBytes int64 = 1024 * 1024
+
+// the header Logplex sets on every request of a drain, it's unique for each app drain
+const DrainTokenHeader string = "Logplex-Drain-Token"
+
+// maps the log lines of a database to the monitored db name its metrics are stored with, an empty field matches any value
+type sourceRule struct {
+	DrainToken string `json:"drain_token,omitempty"`
+	Addon      string `json:"addon,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Dbname     string `json:"dbname"`
+}
+
+// the most specific rule wins: the addon name is unique across all the apps, the drain token identifies an app
+// (whose attachments can have the same source of another app) and the source identifies an attachment of any app.
+// So a rule matching the addon wins over one matching the drain token and the source, then the drain token only,
+// then the source only.
+func (sr sourceRule) specificity() int {
+	n := 0
+	if sr.Addon != "" {
+		n += 4
+	}
+	if sr.DrainToken != "" {
+		n += 2
+	}
+	if sr.Source != "" {
+		n += 1
+	}
+	return n
+}
+
+func (sr sourceRule) matches(drainToken string, addon string, source string) bool {
+	return (sr.DrainToken == "" || sr.DrainToken == drainToken) &&
+		(sr.Addon == "" || sr.Addon == addon) &&
+		(sr.Source == "" || sr.Source == source)
+}
+
+// the source rules, sorted from the most to the least specific
+type sourceRegistry struct {
+	rules []sourceRule
+}
+
+// builds the registry from the SOURCES map, e.g. {"DATABASE": "PGWATCH2_MONITOREDDB_MYTARGETDB_URL"} (a rule matching
+// the source only for each entry), and the source rules. With the same specificity the source rules come first.
+func buildSourceRegistry(sourcesMap map[string]string, rules []sourceRule) (*sourceRegistry, error) {
+	reg := &sourceRegistry{}
+
+	for _, sr := range rules {
+		if sr.Dbname == "" {
+			return nil, fmt.Errorf("dbname is required: %+v", sr)
+		}
+		reg.rules = append(reg.rules, sr)
+	}
+
+	keys := make([]string, 0, len(sourcesMap))
+	for source := range sourcesMap {
+		keys = append(keys, source)
+	}
+	sort.Strings(keys)
+	for _, source := range keys {
+		reg.rules = append(reg.rules, sourceRule{Source: source, Dbname: sourcesMap[source]})
+	}
+
+	sort.SliceStable(reg.rules, func(i, j int) bool {
+		return reg.rules[i].specificity() > reg.rules[j].specificity()
+	})
+	return reg, nil
+}
+
+// returns the monitored db name of the most specific rule matching a log line
+func (reg *sourceRegistry) lookup(drainToken string, addon string, source string) (string, bool) {
+	for _, sr := range reg.rules {
+		if sr.matches(drainToken, addon, source) {
+			return sr.Dbname, true
+		}
+	}
+	return "", false
+}
+
+// the sources config of the sources file and of the POST to /sources
+type sourcesConfig struct {
+	Sources map[string]string `json:"sources,omitempty"`
+	Rules   []sourceRule      `json:"rules,omitempty"`
+}
+
+// validates a sources config, unknown fields are rejected as they are likely a typo
+func parseSourcesConfig(b []byte) (*sourcesConfig, error) {
+	var config sourcesConfig
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid sources config: %w", err)
+	}
+	if _, err := buildSourceRegistry(config.Sources, config.Rules); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// reads the sources config from SOURCES and HKPG_LOGDRAIN_SOURCE_RULES
+func readSourcesEnv() (*sourcesConfig, error) {
+	// {"DATABASE": "PGWATCH2_MONITOREDDB_MYTARGETDB_URL", "DATABASE_ONYX": "PGWATCH2_MONITOREDDB_2_URL", "DATABASE_GREEN": "PGWATCH2_MONITOREDDB_3_URL"}
+	sourcesMap := make(map[string]string)
+	if v, ok := os.LookupEnv(SourcesEnv); ok {
+		if err := json.Unmarshal([]byte(v), &sourcesMap); err != nil {
+			return nil, fmt.Errorf("invalid %v value: %w", SourcesEnv, err)
+		}
+	}
+
+	var rules []sourceRule
+	if v, ok := os.LookupEnv(SourceRulesEnv); ok {
+		if err := json.Unmarshal([]byte(v), &rules); err != nil {
+			return nil, fmt.Errorf("invalid %v value: %w", SourceRulesEnv, err)
+		}
+	}
+
+	if _, err := buildSourceRegistry(sourcesMap, rules); err != nil {
+		return nil, err
+	}
+	return &sourcesConfig{Sources: sourcesMap, Rules: rules}, nil
+}
+
+// sourcesHolder holds the current source registry, which is replaced as a whole by a reload so that the ingest workers
+// never see a partially updated config. A config is validated before it takes effect, an invalid one is discarded and
+// the current registry is kept.
+// The registry is built from the config (of the env, the sources file or the last POST to /sources) and the rules of
+// the drain_sources table (if enabled, see sources_table.go), which come first with the same specificity.
+type sourcesHolder struct {
+	current atomic.Pointer[sourceRegistry]
+	path    string // the sources file, empty if the config is read from the env
+
+	// serializes the reloads
+	mu      sync.Mutex
+	config  *sourcesConfig
+	dbRules []sourceRule
+	modTime time.Time
+	size    int64
+
+	reloads    atomic.Int64
+	failures   atomic.Int64
+	lastReload atomic.Pointer[time.Time]
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+var sources = newSourcesHolder(os.Getenv(SourcesFileEnv))
+
+// loads the initial config, an invalid one results in an empty registry so that the drain starts anyway
+func newSourcesHolder(path string) *sourcesHolder {
+	h := &sourcesHolder{path: path, config: &sourcesConfig{}, stopCh: make(chan struct{})}
+	h.current.Store(&sourceRegistry{})
+
+	if err := h.reload(); err != nil {
+		fmt.Printf("%v, no source configured\n", err)
+	}
+	return h
+}
+
+func (h *sourcesHolder) registry() *sourceRegistry {
+	return h.current.Load()
+}
+
+func (h *sourcesHolder) lookup(drainToken string, addon string, source string) (string, bool) {
+	return h.registry().lookup(drainToken, addon, source)
+}
+
+// replaces the registry if the config is valid, h.mu must be held
+func (h *sourcesHolder) update(config *sourcesConfig, dbRules []sourceRule, err error) error {
+	var reg *sourceRegistry
+	if err == nil {
+		rules := make([]sourceRule, 0, len(dbRules)+len(config.Rules))
+		rules = append(append(rules, dbRules...), config.Rules...)
+		reg, err = buildSourceRegistry(config.Sources, rules)
+	}
+	if err != nil {
+		h.failures.Add(1)
+		return err
+	}
+
+	h.config, h.dbRules = config, dbRules
+	h.current.Store(reg)
+	h.reloads.Add(1)
+	now := time.Now()
+	h.lastReload.Store(&now)
+
+	if isEnv(DebugEnv) {
+		fmt.Printf("[sources.go:update] rules[%+v]\n", reg.rules)
+	}
+	return nil
+}
+
+// reads the config from the sources file, or from the env if there is no sources file (only at startup, as the env of
+// a running dyno never changes)
+func (h *sourcesHolder) reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.path == "" {
+		config, err := readSourcesEnv()
+		return h.update(config, h.dbRules, err)
+	}
+
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return h.update(nil, nil, fmt.Errorf("unable to read sources file %v: %w", h.path, err))
+	}
+	b, err := os.ReadFile(h.path)
+	if err != nil {
+		return h.update(nil, nil, fmt.Errorf("unable to read sources file %v: %w", h.path, err))
+	}
+
+	// an invalid file is not read again until it changes
+	h.modTime, h.size = fi.ModTime(), fi.Size()
+	config, err := parseSourcesConfig(b)
+	return h.update(config, h.dbRules, err)
+}
+
+// replaces the config, e.g. posted to /sources
+func (h *sourcesHolder) setConfig(config *sourcesConfig, err error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.update(config, h.dbRules, err)
+}
+
+// replaces the rules of the drain_sources table
+func (h *sourcesHolder) setDbRules(rules []sourceRule) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.update(h.config, rules, nil)
+}
+
+// reloads the sources file if it has changed since the last reload
+func (h *sourcesHolder) reloadIfChanged() {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	changed := !fi.ModTime().Equal(h.modTime) || fi.Size() != h.size
+	h.mu.Unlock()
+
+	if changed {
+		if err := h.reload(); err != nil {
+			fmt.Printf("sources file not reloaded: %v\n", err)
+		} else {
+			fmt.Printf("sources file %v reloaded\n", h.path)
+		}
+	}
+}
+
+// starts the background goroutine polling the sources file, if any
+func (h *sourcesHolder) watch(interval time.Duration) {
+	if h.path == "" {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultSourcesFilePollInterval
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				h.reloadIfChanged()
+			case <-h.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (h *sourcesHolder) close() {
+	close(h.stopCh)
+	h.wg.Wait()
+}
+
+func (h *sourcesHolder) stats() interface{} {
+	stats := map[string]interface{}{
+		"rules":    h.registry().rules,
+		"reloads":  h.reloads.Load(),
+		"failures": h.failures.Load(),
+	}
+	if t := h.lastReload.Load(); t != nil {
+		stats["last_reload"] = *t
+	}
+	return stats
+}
+
+// POST /sources replaces the sources config until the next reload, the body is a sources config (see SourcesFileEnv).
+// The rules of the drain_sources table are kept. It only applies to the dyno receiving the request, the sources file
+// or the drain_sources table (see sourcesTable) change the config of all the dynos.
+func processSourcesUpdate(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxSourcesConfigBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := sources.setConfig(parseSourcesConfig(b)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("sources config replaced, %v rules\n", len(sources.registry().rules))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,228 @@
+// reference(s):
+// 	https://pkg.go.dev/github.com/lib/pq#hdr-Notifications
+// 	https://www.postgresql.org/docs/current/sql-notify.html
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// when set, the source rules are also read from the drain_sources table of the metrics DB, e.g.
+// insert into drain_sources (addon, dbname) values ('postgresql-defined-24903', 'PGWATCH2_MONITOREDDB_2_URL');
+// Every change is notified to all the dynos, which reload the table. SOURCES (or the sources file) still applies to the
+// log lines without a matching row.
+const SourcesTableEnv string = "HKPG_LOGDRAIN_SOURCES_TABLE"
+
+const sourcesNotifyChannel string = "drain_sources"
+
+// the listener connection is checked when no notification is received for this long
+const sourcesListenerPingInterval time.Duration = 90 * time.Second
+
+// the table set up and load are retried with this backoff until they succeed, e.g. the metrics DB is not reachable at startup
+const sourcesTableRetryDelay time.Duration = time.Second
+const sourcesTableRetryMaxDelay time.Duration = time.Minute
+
+// an empty string matches any value, as the fields of a source rule
+var sourcesTableSetup = []string{
+	`create table if not exists drain_sources (
+		drain_token text not null default '',
+		addon text not null default '',
+		source text not null default '',
+		dbname text not null,
+		primary key (drain_token, addon, source)
+	);`,
+	`create or replace function drain_sources_notify() returns trigger as $$
+	begin
+		perform pg_notify('` + sourcesNotifyChannel + `', tg_op);
+		return null;
+	end;
+	$$ language plpgsql;`,
+	`drop trigger if exists drain_sources_notify on drain_sources;`,
+	`create trigger drain_sources_notify after insert or update or delete or truncate on drain_sources
+		for each statement execute procedure drain_sources_notify();`,
+}
+
+const loadSourcesQuery string = "select drain_token, addon, source, dbname from drain_sources;"
+
+// sourcesTable keeps the rules of the sources holder in sync with the drain_sources table
+type sourcesTable struct {
+	store  *store
+	holder *sourcesHolder
+
+	listener *pq.Listener
+
+	loads         atomic.Int64
+	failures      atomic.Int64
+	notifications atomic.Int64
+
+	// the setups and loads of the loop, canceled by close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newSourcesTable(store *store, holder *sourcesHolder) *sourcesTable {
+	st := &sourcesTable{store: store, holder: holder, stopCh: make(chan struct{})}
+	st.ctx, st.cancel = context.WithCancel(context.Background())
+	return st
+}
+
+// creates the table and its trigger, the advisory lock serializes the dynos starting at the same time
+func (st *sourcesTable) setup(ctx context.Context) error {
+	return withAdvisoryLock(ctx, st.store, "drain_sources", func(tx *sql.Tx) error {
+		for _, query := range sourcesTableSetup {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// reads all the rows and replaces the rules of the holder
+func (st *sourcesTable) load(ctx context.Context) error {
+	var rules []sourceRule
+	err := st.store.withRetry(ctx, "load drain_sources", func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, loadSourcesQuery)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		rules = nil
+		for rows.Next() {
+			var sr sourceRule
+			if err := rows.Scan(&sr.DrainToken, &sr.Addon, &sr.Source, &sr.Dbname); err != nil {
+				return err
+			}
+			rules = append(rules, sr)
+		}
+		return rows.Err()
+	})
+	if err == nil {
+		err = st.holder.setDbRules(rules)
+	}
+
+	if err != nil {
+		st.failures.Add(1)
+		return err
+	}
+
+	st.loads.Add(1)
+	if isEnv(DebugEnv) {
+		fmt.Printf("[sources_table.go:load] %v rules loaded from drain_sources\n", len(rules))
+	}
+	return nil
+}
+
+// sets the table up, loads it and starts listening for its changes.
+// If the table can't be set up or loaded by ctx (e.g. the metrics DB is not reachable yet), it's tried again in the
+// background until it succeeds, the error is returned so that the drain starts with SOURCES only in the meantime.
+// The listener reconnects by itself, the table is loaded again after a reconnection as notifications may have been missed.
+func (st *sourcesTable) start(ctx context.Context) error {
+	dburl, err := st.store.dburl()
+	if err != nil {
+		return err
+	}
+
+	err = st.prepare(ctx)
+
+	// no connection is established here, see loop
+	st.listener = pq.NewListener(dburl, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			fmt.Printf("drain_sources listener: %v\n", err)
+		}
+	})
+
+	st.wg.Add(1)
+	go st.loop(err == nil)
+	return err
+}
+
+// sets the table up and loads it
+func (st *sourcesTable) prepare(ctx context.Context) error {
+	if err := st.setup(ctx); err != nil {
+		return err
+	}
+	return st.load(ctx)
+}
+
+func (st *sourcesTable) loop(prepared bool) {
+	defer st.wg.Done()
+
+	delay := sourcesTableRetryDelay
+	for !prepared {
+		select {
+		case <-time.After(delay):
+		case <-st.stopCh:
+			return
+		}
+
+		if err := st.prepare(st.ctx); err != nil {
+			fmt.Printf("DB error: unable to set up drain_sources, retrying in %v: %v\n", delay, err)
+			if delay *= 2; delay > sourcesTableRetryMaxDelay {
+				delay = sourcesTableRetryMaxDelay
+			}
+			continue
+		}
+		prepared = true
+		fmt.Printf("drain_sources loaded\n")
+	}
+
+	// it waits for the listener to be connected, or closed
+	if err := st.listener.Listen(sourcesNotifyChannel); err != nil {
+		fmt.Printf("drain_sources listener: unable to listen: %v\n", err)
+		return
+	}
+	// the changes done before listening
+	if err := st.load(st.ctx); err != nil {
+		fmt.Printf("DB error: unable to load drain_sources: %v\n", err)
+	}
+
+	for {
+		select {
+		case n := <-st.listener.Notify:
+			// nil after a reconnection
+			if n != nil {
+				st.notifications.Add(1)
+			}
+			if err := st.load(st.ctx); err != nil {
+				fmt.Printf("DB error: unable to load drain_sources: %v\n", err)
+			}
+		case <-time.After(sourcesListenerPingInterval):
+			go func() {
+				_ = st.listener.Ping()
+			}()
+		case <-st.stopCh:
+			return
+		}
+	}
+}
+
+func (st *sourcesTable) close() {
+	close(st.stopCh)
+	st.cancel()
+	// wakes up the loop if it's waiting for the listener connection
+	if st.listener != nil {
+		_ = st.listener.Close()
+	}
+	st.wg.Wait()
+}
+
+func (st *sourcesTable) stats() interface{} {
+	return map[string]interface{}{
+		"loads":         st.loads.Load(),
+		"failures":      st.failures.Load(),
+		"notifications": st.notifications.Load(),
+	}
+}
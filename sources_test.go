@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceRegistryLookup(t *testing.T) {
+	reg, err := buildSourceRegistry(map[string]string{"DATABASE": "default"}, []sourceRule{
+		{Source: "DATABASE", DrainToken: "d.app1", Dbname: "app1"},
+		{DrainToken: "d.app2", Dbname: "app2"},
+		{Addon: "postgresql-defined-24903", Dbname: "addon"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		drainToken, addon, source string
+		dbname                    string
+	}{
+		{"d.app1", "postgresql-other-1", "DATABASE", "app1"},
+		{"d.app1", "postgresql-defined-24903", "DATABASE", "addon"},
+		{"d.app2", "postgresql-other-2", "DATABASE", "app2"},
+		{"d.app3", "postgresql-other-3", "DATABASE", "default"},
+		{"", "", "DATABASE", "default"},
+		{"d.app3", "postgresql-other-3", "DATABASE_ONYX", ""},
+	}
+	for _, tt := range tests {
+		dbname, ok := reg.lookup(tt.drainToken, tt.addon, tt.source)
+		if dbname != tt.dbname || ok != (tt.dbname != "") {
+			t.Errorf("lookup(%v, %v, %v) = %v, %v, expected %v", tt.drainToken, tt.addon, tt.source, dbname, ok, tt.dbname)
+		}
+	}
+
+	if _, err := buildSourceRegistry(nil, []sourceRule{{Source: "DATABASE"}}); err == nil {
+		t.Errorf("expected an error for a rule without dbname")
+	}
+}
+
+func TestSourcesHolderReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sources.json")
+	if err := os.WriteFile(path, []byte(`{"sources": {"DATABASE": "first"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newSourcesHolder(path)
+	if dbname, _ := h.lookup("", "", "DATABASE"); dbname != "first" {
+		t.Fatalf("unexpected dbname[%v]", dbname)
+	}
+
+	// an invalid config doesn't take effect
+	if err := os.WriteFile(path, []byte(`{"source": {"DATABASE": "second"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.reload(); err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+	if dbname, _ := h.lookup("", "", "DATABASE"); dbname != "first" || h.failures.Load() != 1 {
+		t.Errorf("unexpected dbname[%v] failures[%v]", dbname, h.failures.Load())
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"source": "DATABASE", "dbname": "third"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h.reloadIfChanged()
+	if dbname, _ := h.lookup("", "", "DATABASE"); dbname != "third" {
+		t.Errorf("unexpected dbname[%v] after the file changed", dbname)
+	}
+}
+
+func TestProcessSourcesUpdate(t *testing.T) {
+	old := sources
+	defer func() { sources = old }()
+	sources = newSourcesHolder("")
+
+	w := httptest.NewRecorder()
+	processSourcesUpdate(w, httptest.NewRequest(http.MethodPost, "/sources", strings.NewReader(`{"rules": [{"addon": "postgresql-defined-24903"}]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %v for a rule without dbname", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	processSourcesUpdate(w, httptest.NewRequest(http.MethodPost, "/sources", strings.NewReader(`{"rules": [{"addon": "postgresql-defined-24903", "dbname": "addon"}]}`)))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("unexpected status %v", w.Code)
+	}
+	if dbname, _ := sources.lookup("", "postgresql-defined-24903", "DATABASE"); dbname != "addon" {
+		t.Errorf("unexpected dbname[%v]", dbname)
+	}
+}
+
+func TestSourcesHolderDbRules(t *testing.T) {
+	h := newSourcesHolder("")
+	if err := h.setConfig(&sourcesConfig{Sources: map[string]string{"DATABASE": "env"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a row of drain_sources wins over SOURCES with the same specificity
+	if err := h.setDbRules([]sourceRule{{Source: "DATABASE", Dbname: "table"}}); err != nil {
+		t.Fatal(err)
+	}
+	if dbname, _ := h.lookup("", "", "DATABASE"); dbname != "table" {
+		t.Errorf("unexpected dbname[%v]", dbname)
+	}
+
+	// SOURCES is the fallback
+	if err := h.setDbRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if dbname, _ := h.lookup("", "", "DATABASE"); dbname != "env" {
+		t.Errorf("unexpected dbname[%v]", dbname)
+	}
+
+	if err := h.setDbRules([]sourceRule{{Source: "DATABASE"}}); err == nil {
+		t.Errorf("expected an error for a row without dbname")
+	}
+}
+
+func TestAdminAuthError(t *testing.T) {
+	t.Setenv(AuthUserEnv, "u")
+	t.Setenv(AuthSecretEnv, "p")
+	t.Setenv(AdminUserEnv, "")
+	t.Setenv(AdminSecretEnv, "")
+	if adminAuthError() == nil {
+		t.Errorf("expected the admin endpoints to be disabled without admin credentials")
+	}
+
+	// the drain credentials are part of the drain URL
+	t.Setenv(AdminUserEnv, "admin")
+	t.Setenv(AdminSecretEnv, "p")
+	if adminAuthError() == nil {
+		t.Errorf("expected the drain credentials to be rejected")
+	}
+
+	t.Setenv(AdminSecretEnv, "admin-secret")
+	if err := adminAuthError(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
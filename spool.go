@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SpoolDirEnv string = "HKPG_LOGDRAIN_SPOOL_DIR"
+const SpoolMaxBytesEnv string = "HKPG_LOGDRAIN_SPOOL_MAX_BYTES"
+const SpoolMaxAgeEnv string = "HKPG_LOGDRAIN_SPOOL_MAX_AGE"
+const SpoolSegmentBytesEnv string = "HKPG_LOGDRAIN_SPOOL_SEGMENT_BYTES"
+const SpoolReplayIntervalEnv string = "HKPG_LOGDRAIN_SPOOL_REPLAY_INTERVAL"
+
+const defaultSpoolMaxBytes int = 256 * 1024 * 1024
+const defaultSpoolMaxAge time.Duration = 24 * time.Hour
+const defaultSpoolSegmentBytes int = 4 * 1024 * 1024
+const defaultSpoolReplayInterval time.Duration = 30 * time.Second
+
+const spoolSegmentExt string = ".seg"
+
+// a metricRow as stored in a spool segment, one JSON document per line
+type spoolRecord struct {
+	Metric string          `json:"metric"`
+	Time   time.Time       `json:"time"`
+	Dbname string          `json:"dbname"`
+	Data   json.RawMessage `json:"data"`
+	Tags   json.RawMessage `json:"tags,omitempty"`
+}
+
+// spool keeps the rows that could not be written to the metrics DB, so that they can be replayed once it's reachable again.
+// Rows are appended to the active segment file, which is sealed when it grows over segmentBytes. Segments are named after
+// their creation time and replayed oldest first, a segment is deleted once all of its rows have been written.
+// Segments older than maxAge or exceeding maxBytes in total are dropped, oldest first.
+type spool struct {
+	dir          string
+	maxBytes     int64
+	maxAge       time.Duration
+	segmentBytes int64
+
+	mu         sync.Mutex
+	active     *os.File
+	activeName string
+	activeSize int64
+
+	spooled  atomic.Int64
+	replayed atomic.Int64
+	dropped  atomic.Int64
+}
+
+func openSpool(dir string, maxBytes int, maxAge time.Duration, segmentBytes int) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if maxAge <= 0 {
+		maxAge = defaultSpoolMaxAge
+	}
+	if segmentBytes <= 0 {
+		segmentBytes = defaultSpoolSegmentBytes
+	}
+
+	return &spool{
+		dir:          dir,
+		maxBytes:     int64(maxBytes),
+		maxAge:       maxAge,
+		segmentBytes: int64(segmentBytes),
+	}, nil
+}
+
+// appends the rows to the active segment
+func (s *spool) append(rows []metricRow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		// segment names sort in creation order
+		name := fmt.Sprintf("%020d%v", time.Now().UnixNano(), spoolSegmentExt)
+		f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		s.active, s.activeName, s.activeSize = f, name, 0
+	}
+
+	n, err := writeSpoolRows(s.active, rows)
+	s.activeSize += n
+	if err != nil {
+		return err
+	}
+	s.spooled.Add(int64(len(rows)))
+
+	if s.activeSize >= s.segmentBytes {
+		s.seal()
+	}
+
+	s.enforceMaxBytes()
+	return nil
+}
+
+// writes the rows as spool records, one per line, and returns the bytes written
+func writeSpoolRows(f *os.File, rows []metricRow) (int64, error) {
+	var n int64
+	w := bufio.NewWriter(f)
+	for _, row := range rows {
+		line, err := json.Marshal(spoolRecord{Metric: row.metric, Time: row.time, Dbname: row.dbname, Data: row.data, Tags: row.tags})
+		if err != nil {
+			return n, err
+		}
+		line = append(line, '\n')
+		if _, err = w.Write(line); err != nil {
+			return n, err
+		}
+		n += int64(len(line))
+	}
+	return n, w.Flush()
+}
+
+// closes the active segment so that it can be replayed, must be called holding s.mu
+func (s *spool) seal() {
+	if s.active == nil {
+		return
+	}
+	if err := s.active.Close(); err != nil {
+		fmt.Printf("spool: unable to close segment %v: %v\n", s.activeName, err)
+	}
+	s.active, s.activeName, s.activeSize = nil, "", 0
+}
+
+// returns the segment names, oldest first, must be called holding s.mu
+func (s *spool) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), spoolSegmentExt) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// drops the oldest segments until the spool size is within maxBytes, must be called holding s.mu
+func (s *spool) enforceMaxBytes() {
+	names, err := s.segments()
+	if err != nil {
+		fmt.Printf("spool: unable to list segments: %v\n", err)
+		return
+	}
+
+	var total int64
+	sizes := make(map[string]int64, len(names))
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(s.dir, name)); err == nil {
+			sizes[name] = info.Size()
+			total += info.Size()
+		}
+	}
+
+	for _, name := range names {
+		if total <= s.maxBytes {
+			return
+		}
+		if name == s.activeName {
+			s.seal()
+		}
+		total -= sizes[name]
+		s.drop(name, "size cap exceeded")
+	}
+}
+
+// deletes a segment that won't be replayed
+func (s *spool) drop(name string, reason string) {
+	rows, _ := readSpoolSegment(filepath.Join(s.dir, name))
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("spool: unable to remove segment %v: %v\n", name, err)
+		return
+	}
+	s.dropped.Add(int64(len(rows)))
+	fmt.Printf("spool: dropped segment %v with %v rows, %v\n", name, len(rows), reason)
+}
+
+// writes the spooled rows with write, oldest segment first and one metric at a time, as the sinks commit the rows of
+// each metric separately. It stops at the first transient error (e.g. the DB is still unreachable), the segment is
+// rewritten with the rows not written yet so that the next replay doesn't write the others twice.
+// The rows failing with a fatal error (e.g. a constraint violation) are dropped, so that they don't block the spool.
+func (s *spool) replay(write func([]metricRow) error) error {
+	s.mu.Lock()
+	s.seal()
+	names, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > s.maxAge {
+			s.drop(name, "age cap exceeded")
+			continue
+		}
+
+		rows, err := readSpoolSegment(path)
+		if err != nil {
+			fmt.Printf("spool: segment %v partially read: %v\n", name, err)
+		}
+
+		metrics, byMetric := groupRowsByMetric(rows)
+
+		for i, metric := range metrics {
+			err := write(byMetric[metric])
+			if err == nil {
+				s.replayed.Add(int64(len(byMetric[metric])))
+				continue
+			}
+
+			if classifyError(err) == errorFatal {
+				s.dropped.Add(int64(len(byMetric[metric])))
+				fmt.Printf("spool: dropped %v rows of %v of segment %v: %v\n", len(byMetric[metric]), metric, name, err)
+				continue
+			}
+
+			var remaining []metricRow
+			for _, m := range metrics[i:] {
+				remaining = append(remaining, byMetric[m]...)
+			}
+			if i > 0 {
+				if rerr := rewriteSpoolSegment(path, info.ModTime(), remaining); rerr != nil {
+					fmt.Printf("spool: unable to rewrite segment %v, its written rows will be replayed again: %v\n", name, rerr)
+				}
+			}
+			return err
+		}
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		fmt.Printf("spool: replayed segment %v with %v rows\n", name, len(rows))
+	}
+
+	return nil
+}
+
+// replaces the rows of a segment, keeping its modification time as its age is checked against maxAge
+func rewriteSpoolSegment(path string, modTime time.Time, rows []metricRow) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = writeSpoolRows(f, rows); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Chtimes(tmp, modTime, modTime); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reads all the rows of a segment, malformed lines (e.g. a partial write) are skipped
+func readSpoolSegment(path string) ([]metricRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []metricRow
+	var lineErr error
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec spoolRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			lineErr = err
+			continue
+		}
+		rows = append(rows, metricRow{metric: rec.Metric, time: rec.Time, dbname: rec.Dbname, data: rec.Data, tags: rec.Tags})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return rows, err
+	}
+	return rows, lineErr
+}
+
+func (s *spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seal()
+}
+
+func (s *spool) stats() interface{} {
+	s.mu.Lock()
+	names, _ := s.segments()
+	s.mu.Unlock()
+
+	return map[string]interface{}{
+		"dir":      s.dir,
+		"segments": len(names),
+		"spooled":  s.spooled.Load(),
+		"replayed": s.replayed.Load(),
+		"dropped":  s.dropped.Load(),
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestRows(metric string, n int) []metricRow {
+	rows := make([]metricRow, n)
+	for i := range rows {
+		rows[i] = metricRow{metric: metric, time: time.Unix(int64(i), 0).UTC(), dbname: "PGWATCH2_MONITOREDDB_MYTARGETDB_URL", data: []byte(`{"load_1min":0.5}`), tags: []byte(`{"addon":"postgresql-defined-24903"}`)}
+	}
+	return rows
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a segment for each append as segmentBytes is 1
+	if err := s.append(newTestRows("heroku_pg_stats", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append(newTestRows("cpu_load", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write keeps the segments
+	if err := s.replay(func([]metricRow) error { return syscall.ECONNREFUSED }); err == nil {
+		t.Fatalf("expected the replay to fail")
+	}
+	if s.replayed.Load() != 0 {
+		t.Fatalf("replayed %v rows, expected 0", s.replayed.Load())
+	}
+
+	var replayed []metricRow
+	if err := s.replay(func(rows []metricRow) error {
+		replayed = append(replayed, rows...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replayed) != 3 || replayed[0].metric != "heroku_pg_stats" || replayed[1].time.Unix() != 1 || replayed[2].metric != "cpu_load" {
+		t.Errorf("unexpected replayed rows %+v", replayed)
+	}
+	if string(replayed[0].data) != `{"load_1min":0.5}` || string(replayed[0].tags) != `{"addon":"postgresql-defined-24903"}` {
+		t.Errorf("unexpected replayed data %s tags %s", replayed[0].data, replayed[0].tags)
+	}
+	if s.spooled.Load() != 3 || s.replayed.Load() != 3 {
+		t.Errorf("spooled %v replayed %v, expected 3 and 3", s.spooled.Load(), s.replayed.Load())
+	}
+}
+
+func TestSpoolCaps(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 300, time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := s.append(newTestRows("heroku_pg_stats", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.dropped.Load() == 0 {
+		t.Errorf("expected the oldest segments to be dropped by the size cap")
+	}
+
+	names, _ := s.segments()
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, names[0]), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := 0
+	_ = s.replay(func(rows []metricRow) error {
+		replayed += len(rows)
+		return nil
+	})
+	if replayed != len(names)-1 {
+		t.Errorf("replayed %v rows, expected %v as the oldest segment is over the age cap", replayed, len(names)-1)
+	}
+}
+
+func TestSpoolReplayProgress(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a single segment with the rows of 3 metrics
+	if err := s.append(append(append(newTestRows("heroku_pg_stats", 2), newTestRows("cpu_load", 1)...), newTestRows("heroku_pg_extra", 1)...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// heroku_pg_stats is written, cpu_load fails and so the replay stops
+	written := make(map[string]int)
+	err = s.replay(func(rows []metricRow) error {
+		if rows[0].metric == "cpu_load" {
+			return syscall.ECONNREFUSED
+		}
+		written[rows[0].metric] += len(rows)
+		return nil
+	})
+	if err == nil || written["heroku_pg_stats"] != 2 || written["heroku_pg_extra"] != 0 {
+		t.Fatalf("unexpected replay %v %v", written, err)
+	}
+
+	// heroku_pg_stats is not written again, a fatal error doesn't block the following rows
+	err = s.replay(func(rows []metricRow) error {
+		if rows[0].metric == "cpu_load" {
+			return errors.New("invalid input syntax")
+		}
+		written[rows[0].metric] += len(rows)
+		return nil
+	})
+	if err != nil || written["heroku_pg_stats"] != 2 || written["heroku_pg_extra"] != 1 {
+		t.Errorf("unexpected replay %v %v", written, err)
+	}
+	if s.replayed.Load() != 3 || s.dropped.Load() != 1 {
+		t.Errorf("replayed %v dropped %v, expected 3 and 1", s.replayed.Load(), s.dropped.Load())
+	}
+
+	if names, _ := s.segments(); len(names) != 0 {
+		t.Errorf("expected the segment to be removed, got %v", names)
+	}
+}
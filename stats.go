@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// each component registers a function returning its counters, they are all exposed as a single JSON document by /stats
+var statsProvidersMu sync.Mutex
+var statsProviders = make(map[string]func() interface{})
+
+func registerStats(name string, provider func() interface{}) {
+	statsProvidersMu.Lock()
+	defer statsProvidersMu.Unlock()
+
+	statsProviders[name] = provider
+}
+
+func collectStats() map[string]interface{} {
+	statsProvidersMu.Lock()
+	defer statsProvidersMu.Unlock()
+
+	stats := make(map[string]interface{}, len(statsProviders))
+	for name, provider := range statsProviders {
+		stats[name] = provider()
+	}
+	return stats
+}
+
+// GET /stats
+func processStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(collectStats()); err != nil {
+		fmt.Printf("could not encode stats: %v\n", err)
+	}
+}
@@ -0,0 +1,388 @@
+// reference(s):
+// 	https://www.postgresql.org/docs/current/errcodes-appendix.html
+// 	https://devcenter.heroku.com/articles/heroku-postgresql-credentials
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const DbStartupTimeoutEnv string = "HKPG_LOGDRAIN_DB_STARTUP_TIMEOUT"
+const DbMaxRetriesEnv string = "HKPG_LOGDRAIN_DB_MAX_RETRIES"
+
+const defaultDbStartupTimeout time.Duration = 20 * time.Second
+const defaultDbMaxRetries int = 4
+const dbRetryBaseDelay time.Duration = 200 * time.Millisecond
+const dbRetryMaxDelay time.Duration = 10 * time.Second
+
+// how an error returned by the metrics DB must be handled
+type errorClass int
+
+const (
+	errorFatal     errorClass = iota // retrying won't help (e.g. syntax error, constraint violation)
+	errorRetryable                   // transient, the operation can be retried as it is (e.g. deadlock, too many connections)
+	errorReconnect                   // the connection or the prepared statements are no longer valid (e.g. failover)
+	errorDeferred                    // retrying now won't help, but it may once the missing table or partition is created again
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorRetryable:
+		return "retryable"
+	case errorReconnect:
+		return "reconnect"
+	case errorDeferred:
+		return "deferred"
+	default:
+		return "fatal"
+	}
+}
+
+func classifyError(err error) errorClass {
+	// returned by database/sql when the pool or a statement is used while it's being replaced by a reconnection
+	if err != nil && (err.Error() == "sql: database is closed" || err.Error() == "sql: statement is closed") {
+		return errorRetryable
+	}
+
+	// the operation has been interrupted (e.g. by the shutdown deadline), it can be done again later
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return errorRetryable
+	}
+
+	// returned by the sinks not backed by a DB (e.g. remote write) for the errors that can be retried later
+	var sinkErr *retryableSinkError
+	if errors.As(err, &sinkErr) {
+		return errorRetryable
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return errorReconnect
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57014": // query_canceled
+			return errorRetryable
+		case "25006": // read_only_sql_transaction, connected to a standby after a failover
+			return errorReconnect
+		case "26000", "0A000": // invalid_sql_statement_name, cached plan must not change result type: the statements must be prepared again
+			return errorReconnect
+		case "42P01", "23514": // undefined_table, check_violation (no partition for the row): dropped by retention or not ensured yet
+			return errorDeferred
+		}
+
+		switch pqErr.Code.Class() {
+		case "08", "57": // connection_exception, operator_intervention (admin_shutdown, crash_shutdown, cannot_connect_now)
+			return errorReconnect
+		case "28": // invalid_authorization_specification, e.g. the credentials have been rotated and the dyno is about to be restarted
+			return errorReconnect
+		case "40", "53": // transaction_rollback (serialization_failure, deadlock_detected), insufficient_resources
+			return errorRetryable
+		}
+		return errorFatal
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return errorReconnect
+	}
+
+	return errorFatal
+}
+
+// store owns the connection pool to a metrics DB and the statements prepared on it.
+// Operations are retried with jittered exponential backoff on transient errors, on connection errors the pool is
+// opened again and the statements are prepared again. The URL is read from the env, which doesn't change in a running
+// dyno: when the credentials are rotated Heroku restarts the dyno with the new config var, the old ones keep failing until then.
+type store struct {
+	urlEnv     string
+	maxRetries int
+
+	mu      sync.RWMutex
+	db      *sql.DB
+	queries map[string]string    // statement name -> query
+	stmts   map[string]*sql.Stmt // statement name -> prepared statement, prepared on first use
+
+	rndMu sync.Mutex
+	rnd   *rand.Rand
+}
+
+func newStore(urlEnv string, maxRetries int) *store {
+	if maxRetries < 0 {
+		maxRetries = defaultDbMaxRetries
+	}
+
+	return &store{
+		urlEnv:     urlEnv,
+		maxRetries: maxRetries,
+		queries:    make(map[string]string),
+		stmts:      make(map[string]*sql.Stmt),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *store) dburl() (string, error) {
+	dburl := os.Getenv(s.urlEnv) + "?sslmode=require"
+
+	u, err := url.Parse(dburl)
+	if err != nil {
+		return "", fmt.Errorf("invalid metrics DB URL: %w", err)
+	}
+
+	if isEnv(DebugEnv) {
+		fmt.Printf("[store.go:dburl] metrics db url %v\n", u.Redacted())
+	}
+
+	return dburl, nil
+}
+
+// opens the connection pool, no connection is established until it's used
+func (s *store) open() error {
+	dburl, err := s.dburl()
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("postgres", dburl)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.db
+	s.db = db
+	s.stmts = make(map[string]*sql.Stmt)
+	s.mu.Unlock()
+
+	// closing the pool closes its statements too
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// registers a statement, it's prepared the first time it's used
+func (s *store) prepare(name string, query string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queries[name] = query
+}
+
+func (s *store) pool() (*sql.DB, error) {
+	s.mu.RLock()
+	db := s.db
+	s.mu.RUnlock()
+
+	if db == nil {
+		if err := s.open(); err != nil {
+			return nil, err
+		}
+		return s.pool()
+	}
+	return db, nil
+}
+
+func (s *store) stmt(name string) (*sql.Stmt, error) {
+	s.mu.RLock()
+	stmt, ok := s.stmts[name]
+	query, known := s.queries[name]
+	db := s.db
+	s.mu.RUnlock()
+
+	if ok {
+		return stmt, nil
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown statement %v", name)
+	}
+	if db == nil {
+		if _, err := s.pool(); err != nil {
+			return nil, err
+		}
+		return s.stmt(name)
+	}
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.db != db {
+		// the pool has been opened again in the meantime
+		s.mu.Unlock()
+		_ = stmt.Close()
+		return s.stmt(name)
+	}
+	if existing, ok := s.stmts[name]; ok {
+		// prepared concurrently by another goroutine
+		s.mu.Unlock()
+		_ = stmt.Close()
+		return existing, nil
+	}
+	s.stmts[name] = stmt
+	s.mu.Unlock()
+	return stmt, nil
+}
+
+// drops the prepared statements and opens the connection pool again, unless it has been already opened again
+// after the failure of the failed one
+func (s *store) reconnect(failed *sql.DB) {
+	s.mu.RLock()
+	current := s.db
+	s.mu.RUnlock()
+	if failed != nil && current != failed {
+		return
+	}
+
+	if err := s.open(); err != nil {
+		fmt.Printf("DB error: unable to reconnect: %v\n", err)
+	}
+}
+
+// runs op until it succeeds, it fails with a fatal (or deferred) error or it has been retried maxRetries times
+func (s *store) withRetry(ctx context.Context, name string, op func(db *sql.DB) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var db *sql.DB
+		if db, err = s.pool(); err == nil {
+			if err = op(db); err == nil {
+				return nil
+			}
+		}
+
+		class := classifyError(err)
+		if class == errorFatal || class == errorDeferred || attempt >= s.maxRetries {
+			return err
+		}
+
+		if class == errorReconnect {
+			s.reconnect(db)
+		}
+
+		delay := s.backoff(attempt)
+		fmt.Printf("DB error (%v) on %v, retrying in %v: %v\n", class, name, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// exponential backoff with jitter: a random delay between half and the whole of base * 2^attempt
+func (s *store) backoff(attempt int) time.Duration {
+	delay := dbRetryMaxDelay
+	if attempt < 16 {
+		if d := dbRetryBaseDelay << uint(attempt); d < dbRetryMaxDelay {
+			delay = d
+		}
+	}
+
+	s.rndMu.Lock()
+	defer s.rndMu.Unlock()
+	return delay/2 + time.Duration(s.rnd.Int63n(int64(delay/2)+1))
+}
+
+// executes a statement registered with prepare
+func (s *store) exec(ctx context.Context, name string, args ...interface{}) error {
+	return s.withRetry(ctx, name, func(_ *sql.DB) error {
+		stmt, err := s.stmt(name)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, args...)
+		return err
+	})
+}
+
+// executes a statement registered with prepare and scans its single row into dest
+func (s *store) queryRow(ctx context.Context, name string, args []interface{}, dest ...interface{}) error {
+	return s.withRetry(ctx, name, func(_ *sql.DB) error {
+		stmt, err := s.stmt(name)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRowContext(ctx, args...).Scan(dest...)
+	})
+}
+
+func (s *store) ping(ctx context.Context) error {
+	db, err := s.pool()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+// validates the connectivity and prepares all the statements, retrying until ctx is done.
+// It fails immediately if the error is fatal (e.g. the database does not exist).
+func (s *store) waitReady(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		err := s.ping(ctx)
+		if err == nil {
+			s.mu.RLock()
+			names := make([]string, 0, len(s.queries))
+			for name := range s.queries {
+				names = append(names, name)
+			}
+			s.mu.RUnlock()
+
+			for _, name := range names {
+				if _, err = s.stmt(name); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			return nil
+		}
+
+		class := classifyError(err)
+		if class == errorFatal {
+			return err
+		}
+		if class == errorReconnect {
+			s.reconnect(nil)
+		}
+
+		delay := s.backoff(attempt)
+		fmt.Printf("metrics DB not ready (%v), retrying in %v: %v\n", class, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (s *store) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db != nil {
+		_ = s.db.Close()
+		s.db = nil
+	}
+	s.stmts = make(map[string]*sql.Stmt)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected errorClass
+	}{
+		{&pq.Error{Code: "08006"}, errorReconnect}, // connection_failure
+		{&pq.Error{Code: "57P01"}, errorReconnect}, // admin_shutdown
+		{&pq.Error{Code: "28P01"}, errorReconnect}, // invalid_password
+		{&pq.Error{Code: "26000"}, errorReconnect}, // invalid_sql_statement_name
+		{&pq.Error{Code: "40P01"}, errorRetryable}, // deadlock_detected
+		{&pq.Error{Code: "53300"}, errorRetryable}, // too_many_connections
+		{&pq.Error{Code: "57014"}, errorRetryable}, // query_canceled
+		{&pq.Error{Code: "42P01"}, errorDeferred},  // undefined_table
+		{&pq.Error{Code: "23514"}, errorDeferred},  // check_violation, no partition for the row
+		{&pq.Error{Code: "42601"}, errorFatal},     // syntax_error
+		{&pq.Error{Code: "23505"}, errorFatal},     // unique_violation
+		{fmt.Errorf("copy: %w", driver.ErrBadConn), errorReconnect},
+		{errors.New("sql: database is closed"), errorRetryable},
+		{errors.New("something else"), errorFatal},
+	}
+
+	for _, test := range tests {
+		if class := classifyError(test.err); class != test.expected {
+			t.Errorf("classifyError(%v) = %v, expected %v", test.err, class, test.expected)
+		}
+	}
+}
+
+func TestStoreBackoff(t *testing.T) {
+	s := newStore(MetricsDbUrlEnv, 0)
+
+	for attempt := 0; attempt < 20; attempt++ {
+		max := dbRetryMaxDelay
+		if attempt < 6 {
+			max = dbRetryBaseDelay << uint(attempt)
+		}
+		if d := s.backoff(attempt); d < max/2 || d > max {
+			t.Errorf("backoff(%v) = %v, expected between %v and %v", attempt, d, max/2, max)
+		}
+	}
+}
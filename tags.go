@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// static tags added to the tag_data of the rows of each source, e.g. {"DATABASE": {"app": "myapp", "env": "production"}}
+const SourceTagsEnv string = "HKPG_LOGDRAIN_SOURCE_TAGS"
+
+var sourceTags = loadSourceTags()
+
+func loadSourceTags() map[string]map[string]string {
+	tags := make(map[string]map[string]string)
+
+	if v, ok := os.LookupEnv(SourceTagsEnv); ok {
+		if err := json.Unmarshal([]byte(v), &tags); err != nil {
+			fmt.Printf("invalid %v value[%v], static tags disabled: %v\n", SourceTagsEnv, v, err)
+			return make(map[string]map[string]string)
+		}
+	}
+	return tags
+}
+
+// returns the pgwatch2 tag_data of the rows of a log line: the static tags of its source and its identity
+// (addon, source and the Logplex hostname and name), which take precedence. Empty values are omitted.
+func (r *herokuPostgresLog) tagData(static map[string]map[string]string) []byte {
+	tags := make(map[string]string)
+	for k, v := range static[r.source] {
+		tags[k] = v
+	}
+
+	for k, v := range map[string]string{"addon": r.addon, "source": r.source, "hostname": r.hostname, "name": r.name} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(tags)
+	if err != nil {
+		fmt.Printf("could not marshal json: %s\n", err)
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestHerokuPostgresLogTagData(t *testing.T) {
+	rl := parseTestLogLine(t, testHerokuPostgresLogLine)
+	rl.hostname = "host"
+	rl.name = "app"
+
+	static := map[string]map[string]string{
+		"DATABASE":      {"env": "production", "addon": "overridden"},
+		"DATABASE_ONYX": {"env": "staging"},
+	}
+
+	// json.Marshal sorts the map keys
+	expected := `{"addon":"postgresql-defined-24903","env":"production","hostname":"host","name":"app","source":"DATABASE"}`
+	if tags := string(rl.tagData(static)); tags != expected {
+		t.Errorf("unexpected tags %v, expected %v", tags, expected)
+	}
+
+	if tags := newHerokuPostgresLog(nil).tagData(static); tags != nil {
+		t.Errorf("unexpected tags %s", tags)
+	}
+}
@@ -0,0 +1,437 @@
+// reference(s):
+// 	https://docs.timescale.com/api/latest/hypertable/create_hypertable/
+// 	https://docs.timescale.com/api/latest/compression/add_compression_policy/
+// 	https://docs.timescale.com/api/latest/data-retention/add_retention_policy/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const TimescaleSinkName string = "timescale"
+
+const TimescaleDbUrlEnv string = "TIMESCALE_URL"
+
+// the schema of the hypertables, public by default
+const TimescaleSchemaEnv string = "HKPG_LOGDRAIN_TIMESCALE_SCHEMA"
+
+// jsonb (the default) stores the data as in pgwatch2 (time, dbname, data, tag_data), columns stores a typed column
+// for each field of the data, added as the fields are received
+const TimescaleLayoutEnv string = "HKPG_LOGDRAIN_TIMESCALE_LAYOUT"
+
+const TimescaleChunkIntervalEnv string = "HKPG_LOGDRAIN_TIMESCALE_CHUNK_INTERVAL"
+
+// optional, the chunks older than this are compressed, e.g. 7d
+const TimescaleCompressAfterEnv string = "HKPG_LOGDRAIN_TIMESCALE_COMPRESS_AFTER"
+
+// optional, the chunks older than the retention of their metric are dropped, same format of HKPG_LOGDRAIN_RETENTION
+// e.g. {"heroku_pg_stats": "90d", "*": "30d"}
+const TimescaleRetentionEnv string = "HKPG_LOGDRAIN_TIMESCALE_RETENTION"
+
+const (
+	TimescaleLayoutJsonb   string = "jsonb"
+	TimescaleLayoutColumns string = "columns"
+)
+
+const defaultTimescaleSchema string = "public"
+const defaultTimescaleChunkInterval time.Duration = 7 * 24 * time.Hour
+
+const timescaleExtensionQuery string = "select extversion from pg_extension where extname = 'timescaledb';"
+
+const timescaleCompressionQuery string = `select coalesce((select compression_enabled from timescaledb_information.hypertables
+where hypertable_schema = $1 and hypertable_name = $2), false);`
+
+// timescaleSink writes the rows into a hypertable for each metric, which is created (with its compression and
+// retention policies) the first time the metric is written. Chunks are created by TimescaleDB, so there is no
+// partition to ensure.
+type timescaleSink struct {
+	store         *store
+	schema        string
+	layout        string
+	chunkInterval time.Duration
+	compressAfter time.Duration            // 0 if compression is disabled
+	retention     map[string]time.Duration // metric name (or retentionDefaultKey) -> retention period
+
+	mu     sync.Mutex
+	tables map[string]map[string]string // metric name -> column -> type, the data columns only in the columns layout
+
+	// the DDL transactions of ensureTable, so that mu is not held across them
+	flights flightGroup
+
+	mismatches atomic.Int64
+}
+
+func newTimescaleSinkFromEnv() (Sink, error) {
+	if !isEnv(TimescaleDbUrlEnv) {
+		return nil, fmt.Errorf("%v not set", TimescaleDbUrlEnv)
+	}
+
+	ts := &timescaleSink{
+		store:         newStore(TimescaleDbUrlEnv, envInt(DbMaxRetriesEnv, defaultDbMaxRetries)),
+		schema:        os.Getenv(TimescaleSchemaEnv),
+		layout:        os.Getenv(TimescaleLayoutEnv),
+		chunkInterval: envDuration(TimescaleChunkIntervalEnv, defaultTimescaleChunkInterval),
+		tables:        make(map[string]map[string]string),
+	}
+	if ts.schema == "" {
+		ts.schema = defaultTimescaleSchema
+	}
+
+	switch ts.layout {
+	case "":
+		ts.layout = TimescaleLayoutJsonb
+	case TimescaleLayoutJsonb, TimescaleLayoutColumns:
+	default:
+		return nil, fmt.Errorf("invalid %v value[%v], it must be %v or %v", TimescaleLayoutEnv, ts.layout, TimescaleLayoutJsonb, TimescaleLayoutColumns)
+	}
+
+	if v, ok := os.LookupEnv(TimescaleCompressAfterEnv); ok {
+		d, err := parseRetention(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v value[%v]: %w", TimescaleCompressAfterEnv, v, err)
+		}
+		ts.compressAfter = d
+	}
+
+	if v, ok := os.LookupEnv(TimescaleRetentionEnv); ok {
+		retention, err := parseRetentionConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v value[%v]: %w", TimescaleRetentionEnv, v, err)
+		}
+		ts.retention = retention
+	}
+
+	registerStats("timescale", ts.stats)
+	return ts, nil
+}
+
+// validates the connectivity and checks that the TimescaleDB extension is installed
+func (ts *timescaleSink) open(ctx context.Context) error {
+	if err := ts.store.waitReady(ctx); err != nil {
+		if classifyError(err) == errorFatal {
+			return err
+		}
+		fmt.Printf("TimescaleDB not ready, starting anyway: %v\n", err)
+		return nil
+	}
+
+	var version string
+	err := ts.store.withRetry(ctx, "timescaledb extension", func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, timescaleExtensionQuery).Scan(&version)
+	})
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("the timescaledb extension is not installed in %v", TimescaleDbUrlEnv)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("TimescaleDB %v, %v layout\n", version, ts.layout)
+	return nil
+}
+
+func (ts *timescaleSink) table(metric string) string {
+	return pq.QuoteIdentifier(ts.schema) + "." + pq.QuoteIdentifier(metric)
+}
+
+// rows of the same metric keep their order, transient errors are retried by the store
+func (ts *timescaleSink) WriteBatch(ctx context.Context, rows []metricRow) error {
+	metrics, byMetric := groupRowsByMetric(rows)
+	for _, metric := range metrics {
+		if err := ts.copyRows(ctx, metric, byMetric[metric]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *timescaleSink) copyRows(ctx context.Context, metric string, rows []metricRow) error {
+	if ts.layout == TimescaleLayoutJsonb {
+		if err := ts.ensureTable(ctx, metric, nil); err != nil {
+			return err
+		}
+
+		return ts.store.withRetry(ctx, "copy into "+metric, func(db *sql.DB) error {
+			return copyRowsTx(ctx, db, ts.schema, metric, metricRowColumns, len(rows), func(i int) ([]interface{}, error) {
+				return metricRowValues(rows[i]), nil
+			})
+		})
+	}
+
+	data := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		var err error
+		if data[i], err = decodeTimescaleData(row.data); err != nil {
+			return err
+		}
+	}
+
+	columns := timescaleColumns(data)
+	if err := ts.ensureTable(ctx, metric, columns); err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	types := ts.tables[metric]
+	ts.mu.Unlock()
+
+	names := make([]string, 0, len(columns))
+	for column := range columns {
+		names = append(names, column)
+	}
+	sort.Strings(names)
+
+	return ts.store.withRetry(ctx, "copy into "+metric, func(db *sql.DB) error {
+		return copyRowsTx(ctx, db, ts.schema, metric, append(append([]string{"time", "dbname"}, names...), "tag_data"), len(rows), func(i int) ([]interface{}, error) {
+			values := []interface{}{rows[i].time, rows[i].dbname}
+			for _, column := range names {
+				v, err := ts.columnValue(data[i][column], types[column])
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+			return append(values, metricRowTags(rows[i])), nil
+		})
+	})
+}
+
+// creates the hypertable of metric with its policies the first time it's written and, in the columns layout,
+// adds the columns not seen yet. Other dynos may be doing the same, see withAdvisoryLock.
+// A single DDL transaction is in flight for each metric, ts.mu is not held across it.
+func (ts *timescaleSink) ensureTable(ctx context.Context, metric string, columns map[string]string) error {
+	for {
+		if _, missing := ts.missingColumns(metric, columns); missing == nil {
+			return nil
+		}
+
+		// the call in flight may have been adding other columns, they are checked again once it's done
+		err := ts.flights.do(ctx, metric, func() error {
+			known, missing := ts.missingColumns(metric, columns)
+			if missing == nil {
+				return nil
+			}
+			return ts.alterTable(ctx, metric, columns, known != nil, missing)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// returns the known columns of metric, nil if its table is not known yet, and the columns missing from them, nil if none
+func (ts *timescaleSink) missingColumns(metric string, columns map[string]string) (map[string]string, []string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	known, ok := ts.tables[metric]
+	missing := []string{}
+	for column := range columns {
+		if _, ok := known[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	sort.Strings(missing)
+
+	if ok && len(missing) == 0 {
+		return known, nil
+	}
+	return known, missing
+}
+
+// creates the table of metric if it's not known yet, and adds the missing columns
+func (ts *timescaleSink) alterTable(ctx context.Context, metric string, columns map[string]string, ok bool, missing []string) error {
+	table := ts.table(metric)
+	err := withAdvisoryLock(ctx, ts.store, "timescale:"+metric, func(tx *sql.Tx) error {
+		var queries []string
+		if !ok {
+			queries = ts.createQueries(metric)
+		}
+		for _, column := range missing {
+			queries = append(queries, fmt.Sprintf("alter table %v add column if not exists %v %v;", table, pq.QuoteIdentifier(column), columns[column]))
+		}
+
+		for _, query := range queries {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		if ok {
+			return nil
+		}
+
+		// the hypertable may have been created (and its chunks compressed) before a restart, its compression settings
+		// can't be changed once a chunk is compressed
+		var compressionEnabled bool
+		if err := tx.QueryRowContext(ctx, timescaleCompressionQuery, ts.schema, metric).Scan(&compressionEnabled); err != nil {
+			return err
+		}
+		for _, query := range ts.policyQueries(metric, compressionEnabled) {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the known columns are replaced as a whole, as copyRows reads them without holding ts.mu
+	ts.mu.Lock()
+	known := make(map[string]string, len(ts.tables[metric])+len(missing))
+	for column, columnType := range ts.tables[metric] {
+		known[column] = columnType
+	}
+	for _, column := range missing {
+		known[column] = columns[column]
+	}
+	ts.tables[metric] = known
+	ts.mu.Unlock()
+
+	if isEnv(DebugEnv) {
+		fmt.Printf("[timescale_sink.go:ensureTable] %v ready, columns added %v\n", table, missing)
+	}
+	return nil
+}
+
+// returns the statements creating the hypertable of metric
+func (ts *timescaleSink) createQueries(metric string) []string {
+	table := ts.table(metric)
+
+	data := "data jsonb not null,"
+	if ts.layout == TimescaleLayoutColumns {
+		data = ""
+	}
+	return []string{
+		fmt.Sprintf("create table if not exists %v (time timestamptz not null, dbname text not null, %v tag_data jsonb);", table, data),
+		fmt.Sprintf("select create_hypertable('%v', 'time', chunk_time_interval => interval '%d seconds', if_not_exists => true);", table, int64(ts.chunkInterval.Seconds())),
+		fmt.Sprintf("create index if not exists %v on %v (dbname, time desc);", pq.QuoteIdentifier(metric+"_dbname_time_idx"), table),
+	}
+}
+
+// returns the statements adding the compression and retention policies of the hypertable of metric, the
+// compression is only enabled if it's not already
+func (ts *timescaleSink) policyQueries(metric string, compressionEnabled bool) []string {
+	table := ts.table(metric)
+
+	var queries []string
+	if ts.compressAfter > 0 {
+		if !compressionEnabled {
+			queries = append(queries, fmt.Sprintf("alter table %v set (timescaledb.compress, timescaledb.compress_segmentby = 'dbname');", table))
+		}
+		queries = append(queries, fmt.Sprintf("select add_compression_policy('%v', interval '%d seconds', if_not_exists => true);", table, int64(ts.compressAfter.Seconds())))
+	}
+
+	retention, ok := ts.retention[metric]
+	if !ok {
+		retention, ok = ts.retention[retentionDefaultKey]
+	}
+	if ok {
+		queries = append(queries, fmt.Sprintf("select add_retention_policy('%v', interval '%d seconds', if_not_exists => true);", table, int64(retention.Seconds())))
+	}
+	return queries
+}
+
+// numbers are kept as json.Number, so that their type can be inferred from the JSON
+func decodeTimescaleData(b []byte) (map[string]interface{}, error) {
+	var data map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// returns the column type of each field of the rows data, numbers are double precision as the same field can be
+// an integer in a row and a float in another (e.g. read-iops)
+func timescaleColumns(data []map[string]interface{}) map[string]string {
+	columns := make(map[string]string)
+	for _, d := range data {
+		for field, v := range d {
+			if _, ok := columns[field]; !ok {
+				columns[field] = timescaleColumnType(v)
+			}
+		}
+	}
+	return columns
+}
+
+func timescaleColumnType(v interface{}) string {
+	switch v.(type) {
+	case json.Number:
+		return "double precision"
+	case string:
+		return "text"
+	case bool:
+		return "boolean"
+	default:
+		return "jsonb"
+	}
+}
+
+// returns the value of a data field for its column, a value whose type doesn't match the column one (e.g. a field
+// that was a number and now is a string) is stored as NULL
+func (ts *timescaleSink) columnValue(v interface{}, columnType string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if timescaleColumnType(v) != columnType {
+		ts.mismatches.Add(1)
+		return nil, nil
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case string, bool:
+		return v, nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+// rows are written by WriteBatch
+func (ts *timescaleSink) Flush(_ context.Context) error {
+	return nil
+}
+
+func (ts *timescaleSink) Close(_ context.Context) error {
+	ts.store.close()
+	return nil
+}
+
+func (ts *timescaleSink) ping(ctx context.Context) error {
+	return ts.store.ping(ctx)
+}
+
+func (ts *timescaleSink) stats() interface{} {
+	ts.mu.Lock()
+	tables := make([]string, 0, len(ts.tables))
+	for metric := range ts.tables {
+		tables = append(tables, metric)
+	}
+	ts.mu.Unlock()
+	sort.Strings(tables)
+
+	return map[string]interface{}{
+		"layout":          ts.layout,
+		"tables":          tables,
+		"type_mismatches": ts.mismatches.Load(),
+	}
+}
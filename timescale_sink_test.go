@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTimescaleSinkFromEnv(t *testing.T) {
+	t.Setenv(TimescaleDbUrlEnv, "")
+	os.Unsetenv(TimescaleDbUrlEnv)
+	if _, err := newTimescaleSinkFromEnv(); err == nil {
+		t.Errorf("expected an error without %v", TimescaleDbUrlEnv)
+	}
+
+	t.Setenv(TimescaleDbUrlEnv, "postgres://localhost/metrics")
+	t.Setenv(TimescaleLayoutEnv, "wide")
+	if _, err := newTimescaleSinkFromEnv(); err == nil {
+		t.Errorf("expected an error for an invalid layout")
+	}
+
+	t.Setenv(TimescaleLayoutEnv, TimescaleLayoutColumns)
+	t.Setenv(TimescaleCompressAfterEnv, "7d")
+	t.Setenv(TimescaleRetentionEnv, `{"heroku_pg_stats": "90d", "*": "30d"}`)
+	sink, err := newTimescaleSinkFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := sink.(*timescaleSink)
+	if ts.schema != defaultTimescaleSchema || ts.chunkInterval != defaultTimescaleChunkInterval {
+		t.Errorf("unexpected defaults %v %v", ts.schema, ts.chunkInterval)
+	}
+	if ts.compressAfter != 7*24*time.Hour || ts.retention["heroku_pg_stats"] != 90*24*time.Hour {
+		t.Errorf("unexpected policies %v %v", ts.compressAfter, ts.retention)
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestTimescaleColumns(t *testing.T) {
+	ts := &timescaleSink{}
+
+	var data []map[string]interface{}
+	for _, b := range []string{
+		`{"load-avg-1m": 0.1, "addon": "postgresql-round-12345", "stats": {"a": 1}}`,
+		`{"load-avg-1m": 2, "healthy": true, "addon": 3}`,
+	} {
+		d, err := decodeTimescaleData([]byte(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, d)
+	}
+
+	columns := timescaleColumns(data)
+	expected := map[string]string{
+		"load-avg-1m": "double precision",
+		"addon":       "text",
+		"stats":       "jsonb",
+		"healthy":     "boolean",
+	}
+	if len(columns) != len(expected) {
+		t.Errorf("unexpected columns %v", columns)
+	}
+	for column, columnType := range expected {
+		if columns[column] != columnType {
+			t.Errorf("expected %v to be %v, got %v", column, columnType, columns[column])
+		}
+	}
+
+	if v, err := ts.columnValue(data[1]["load-avg-1m"], columns["load-avg-1m"]); err != nil || v != float64(2) {
+		t.Errorf("unexpected value %v %v", v, err)
+	}
+	if v, err := ts.columnValue(data[0]["stats"], columns["stats"]); err != nil || v != `{"a":1}` {
+		t.Errorf("unexpected value %v %v", v, err)
+	}
+	if v, err := ts.columnValue(data[0]["healthy"], columns["healthy"]); err != nil || v != nil {
+		t.Errorf("expected a missing field to be NULL, got %v %v", v, err)
+	}
+
+	// addon was a string in the first row
+	if v, err := ts.columnValue(data[1]["addon"], columns["addon"]); err != nil || v != nil {
+		t.Errorf("expected a type mismatch to be NULL, got %v %v", v, err)
+	}
+	if ts.mismatches.Load() != 1 {
+		t.Errorf("expected 1 type mismatch, got %v", ts.mismatches.Load())
+	}
+}
+
+func TestTimescalePolicyQueries(t *testing.T) {
+	ts := &timescaleSink{
+		schema:        defaultTimescaleSchema,
+		compressAfter: 7 * 24 * time.Hour,
+		retention:     map[string]time.Duration{retentionDefaultKey: 30 * 24 * time.Hour},
+	}
+
+	queries := ts.policyQueries("heroku_pg_stats", false)
+	if len(queries) != 3 || !strings.Contains(queries[0], "timescaledb.compress,") {
+		t.Errorf("expected the compression to be enabled, got %v", queries)
+	}
+
+	// a restart against a hypertable whose chunks are already compressed, its compression settings can't be changed
+	queries = ts.policyQueries("heroku_pg_stats", true)
+	if len(queries) != 2 {
+		t.Fatalf("unexpected queries %v", queries)
+	}
+	for _, query := range queries {
+		if strings.Contains(query, "alter table") {
+			t.Errorf("expected the compression settings not to be changed, got %v", query)
+		}
+	}
+	if !strings.Contains(queries[0], "add_compression_policy") || !strings.Contains(queries[1], "add_retention_policy") {
+		t.Errorf("expected the policies to be added if missing, got %v", queries)
+	}
+}
+
+func TestTimescaleMissingColumns(t *testing.T) {
+	ts := &timescaleSink{tables: make(map[string]map[string]string)}
+	columns := map[string]string{"load-avg-1m": "double precision", "addon": "text"}
+
+	// the table is created even without data columns, e.g. in the jsonb layout
+	if known, missing := ts.missingColumns("heroku_pg_stats", nil); known != nil || missing == nil {
+		t.Errorf("expected an unknown table, got %v %v", known, missing)
+	}
+
+	ts.tables["heroku_pg_stats"] = map[string]string{"addon": "text"}
+	if _, missing := ts.missingColumns("heroku_pg_stats", columns); len(missing) != 1 || missing[0] != "load-avg-1m" {
+		t.Errorf("unexpected missing columns %v", missing)
+	}
+
+	// no DDL for a known table and columns
+	ts.tables["heroku_pg_stats"]["load-avg-1m"] = "double precision"
+	if err := ts.ensureTable(context.Background(), "heroku_pg_stats", columns); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // POST sample
@@ -20,13 +21,54 @@ import (
 
 const AuthUserEnv string = "AUTH_USER"
 const AuthSecretEnv string = "AUTH_SECRET"
+
+// the credentials of the admin endpoints (POST /sources), they must differ from AUTH_USER/AUTH_SECRET as those are part
+// of the drain URL. The admin endpoints are disabled if they are not set.
+const AdminUserEnv string = "HKPG_LOGDRAIN_ADMIN_USER"
+const AdminSecretEnv string = "HKPG_LOGDRAIN_ADMIN_SECRET"
 const PortEnv string = "PORT"
 const SourcesEnv string = "SOURCES"
+const ShutdownTimeoutEnv string = "HKPG_LOGDRAIN_SHUTDOWN_TIMEOUT"
+
+// Heroku sends SIGKILL 30s after SIGTERM, the pending samples must be written before
+const defaultShutdownTimeout time.Duration = 25 * time.Second
 
 func main() {
 	var srv http.Server
 	srv.Addr = ":" + os.Getenv(PortEnv)
 
+	if err := startMetricsDB(); err != nil {
+		panic(err)
+	}
+
+	ingest = newIngestPipeline(envInt(QueueSizeEnv, defaultQueueSize), envInt(WorkersEnv, defaultWorkers), os.Getenv(QueueFullPolicyEnv), processSample)
+	ingest.start()
+	registerStats("ingest", ingest.stats)
+
+	// the age of datfrozenxid of the monitored dbs, for the wraparound proximity of the rates
+	if xidAges != nil {
+		xidAges.start()
+	}
+
+	// the sources config can be changed without a restart, which would drop the requests in flight
+	sources.watch(envDuration(SourcesFilePollIntervalEnv, defaultSourcesFilePollInterval))
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			// the env of a running dyno never changes, a config var change restarts it
+			if sources.path == "" {
+				fmt.Printf("Received SIGHUP, nothing to reload without a sources file (%v)\n", SourcesFileEnv)
+				continue
+			}
+			if err := sources.reload(); err != nil {
+				fmt.Printf("Received SIGHUP, sources config not reloaded: %v\n", err)
+			} else {
+				fmt.Printf("Received SIGHUP, sources config reloaded\n")
+			}
+		}
+	}()
+
 	// Catching signals in a goroutine so that it won't block and wait for all the http Server connections are closed before exiting
 	idleConnsClosed := make(chan struct{})
 	go func() {
@@ -36,16 +78,35 @@ func main() {
 
 		fmt.Printf("Received SIGINT/SIGTERM, shutting down ...\n")
 
+		ctx, cancel := context.WithTimeout(context.Background(), envDuration(ShutdownTimeoutEnv, defaultShutdownTimeout))
+		defer cancel()
+
 		// We received an interrupt signal, shut down.
-		if err := srv.Shutdown(context.Background()); err != nil {
+		if err := srv.Shutdown(ctx); err != nil {
 			// Error from closing listeners, or context timeout:
 			fmt.Printf("Error while shutting down %v\n", err)
 		}
+
+		// no more requests are accepted, store the samples still in the queue and then write the metrics still waiting in the batch
+		if err := ingest.close(ctx); err != nil {
+			fmt.Printf("Error while draining the ingest queue %v\n", err)
+		}
+		sources.close()
+		if xidAges != nil {
+			xidAges.close()
+		}
+		stopMetricsDB(ctx)
 		close(idleConnsClosed)
 	}()
 
 	// defautl handlefunc used by srv.ListenAndServe() below
-	http.HandleFunc("/log", checkAuth(os.Getenv(AuthUserEnv), os.Getenv(AuthSecretEnv), processLogs))
+	http.HandleFunc("/log", checkAuth(http.MethodPost, os.Getenv(AuthUserEnv), os.Getenv(AuthSecretEnv), processLogs))
+	http.HandleFunc("/stats", checkAuth(http.MethodGet, os.Getenv(AuthUserEnv), os.Getenv(AuthSecretEnv), processStats))
+	if err := adminAuthError(); err != nil {
+		fmt.Printf("Admin endpoints disabled: %v\n", err)
+	} else {
+		http.HandleFunc("/sources", checkAuth(http.MethodPost, os.Getenv(AdminUserEnv), os.Getenv(AdminSecretEnv), processSourcesUpdate))
+	}
 	fmt.Printf("Listening on PORT[%v] ...\n", os.Getenv(PortEnv))
 	err := srv.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -57,12 +118,24 @@ func main() {
 	fmt.Printf("... exiting\n")
 }
 
-func checkAuth(correctUser string, correctPass string, pass http.HandlerFunc) http.HandlerFunc {
+// returns why the admin credentials can't be used, if they can't
+func adminAuthError() error {
+	user, secret := os.Getenv(AdminUserEnv), os.Getenv(AdminSecretEnv)
+	if user == "" || secret == "" {
+		return fmt.Errorf("%v and %v not set", AdminUserEnv, AdminSecretEnv)
+	}
+	if user == os.Getenv(AuthUserEnv) || secret == os.Getenv(AuthSecretEnv) {
+		return fmt.Errorf("%v and %v must differ from the drain credentials %v and %v", AdminUserEnv, AdminSecretEnv, AuthUserEnv, AuthSecretEnv)
+	}
+	return nil
+}
+
+func checkAuth(method string, correctUser string, correctPass string, pass http.HandlerFunc) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		if r.Method != http.MethodPost {
-			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		if r.Method != method {
+			http.Error(w, "only "+method+" is allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
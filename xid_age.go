@@ -0,0 +1,197 @@
+// reference(s):
+// 	https://www.postgresql.org/docs/current/routine-vacuuming.html#VACUUM-FOR-WRAPAROUND
+// 	https://devcenter.heroku.com/articles/heroku-postgresql-credentials
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Heroku doesn't report the age of datfrozenxid in the logs, it's read from the monitored dbs listed here, e.g.
+// {"PGWATCH2_MONITOREDDB_MYTARGETDB_URL": "HEROKU_POSTGRESQL_ONYX_URL"}: monitored db name -> env var of its URL,
+// e.g. of a credential attached to the drain app. The ages are added to the rates (see RatesEnv).
+const XidAgeSourcesEnv string = "HKPG_LOGDRAIN_XID_AGE_SOURCES"
+const XidAgeIntervalEnv string = "HKPG_LOGDRAIN_XID_AGE_INTERVAL"
+
+const defaultXidAgeInterval time.Duration = 5 * time.Minute
+const xidAgeTimeout time.Duration = 10 * time.Second
+
+// the oldest datfrozenxid of all the databases of the server (template0 included), as the xids are shared by them
+const xidAgeQuery string = "select max(age(datfrozenxid))::int8, current_setting('autovacuum_freeze_max_age')::int8 from pg_database;"
+
+// the xid age at which Postgres stops assigning xids to prevent the wraparound (2^31, less a few millions)
+const xidWraparoundAge float64 = 1 << 31
+
+// the last age read of a monitored db
+type xidAge struct {
+	t            time.Time
+	age          int64
+	freezeMaxAge int64
+}
+
+// xidAgeMonitor reads the age of datfrozenxid of each configured monitored db every interval, a db not reachable is
+// read again at the next interval
+type xidAgeMonitor struct {
+	stores   map[string]*store // monitored db name -> its DB
+	interval time.Duration
+
+	mu       sync.Mutex
+	ages     map[string]xidAge
+	failures map[string]int64
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+var xidAges = newXidAgeMonitorFromEnv()
+
+func init() {
+	if xidAges != nil {
+		registerStats("xid_age", xidAges.stats)
+	}
+}
+
+// returns nil if no monitored db is configured
+func newXidAgeMonitorFromEnv() *xidAgeMonitor {
+	v, ok := os.LookupEnv(XidAgeSourcesEnv)
+	if !ok {
+		return nil
+	}
+
+	var urlEnvs map[string]string
+	if err := json.Unmarshal([]byte(v), &urlEnvs); err != nil {
+		fmt.Printf("invalid %v value, xid age disabled: %v\n", XidAgeSourcesEnv, err)
+		return nil
+	}
+	return newXidAgeMonitor(urlEnvs, envDuration(XidAgeIntervalEnv, defaultXidAgeInterval))
+}
+
+func newXidAgeMonitor(urlEnvs map[string]string, interval time.Duration) *xidAgeMonitor {
+	if interval <= 0 {
+		interval = defaultXidAgeInterval
+	}
+
+	m := &xidAgeMonitor{
+		stores:   make(map[string]*store, len(urlEnvs)),
+		interval: interval,
+		ages:     make(map[string]xidAge),
+		failures: make(map[string]int64),
+		stopCh:   make(chan struct{}),
+	}
+	for dbname, urlEnv := range urlEnvs {
+		if !isEnv(urlEnv) {
+			fmt.Printf("%v: %v not set, the xid age of %v is not read\n", XidAgeSourcesEnv, urlEnv, dbname)
+			continue
+		}
+		// a single attempt, the next one is at the next interval
+		m.stores[dbname] = newStore(urlEnv, 0)
+	}
+	return m
+}
+
+// returns the last age read of dbname, if it's not older than two intervals
+func (m *xidAgeMonitor) latest(dbname string, now time.Time) (xidAge, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.ages[dbname]
+	if !ok || now.Sub(a.t) > 2*m.interval {
+		return xidAge{}, false
+	}
+	return a, true
+}
+
+func (m *xidAgeMonitor) read(dbname string, s *store) {
+	ctx, cancel := context.WithTimeout(context.Background(), xidAgeTimeout)
+	defer cancel()
+
+	var a xidAge
+	err := s.withRetry(ctx, "xid age", func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, xidAgeQuery).Scan(&a.age, &a.freezeMaxAge)
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.failures[dbname]++
+		fmt.Printf("DB error: unable to read the xid age of %v: %v\n", dbname, err)
+		return
+	}
+	a.t = time.Now()
+	m.ages[dbname] = a
+
+	if isEnv(DebugEnv) {
+		fmt.Printf("[xid_age.go:read] %v xid age %v, autovacuum_freeze_max_age %v\n", dbname, a.age, a.freezeMaxAge)
+	}
+}
+
+func (m *xidAgeMonitor) readAll() {
+	for dbname, s := range m.stores {
+		m.read(dbname, s)
+	}
+}
+
+func (m *xidAgeMonitor) start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		m.readAll()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.readAll()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (m *xidAgeMonitor) close() {
+	close(m.stopCh)
+	m.wg.Wait()
+
+	for _, s := range m.stores {
+		s.close()
+	}
+}
+
+func (m *xidAgeMonitor) stats() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbnames := make([]string, 0, len(m.stores))
+	for dbname := range m.stores {
+		dbnames = append(dbnames, dbname)
+	}
+	sort.Strings(dbnames)
+
+	ages := make(map[string]int64, len(m.ages))
+	for dbname, a := range m.ages {
+		ages[dbname] = a.age
+	}
+	failures := make(map[string]int64, len(m.failures))
+	for dbname, n := range m.failures {
+		failures[dbname] = n
+	}
+
+	return map[string]interface{}{
+		"dbnames":  dbnames,
+		"ages":     ages,
+		"failures": failures,
+	}
+}